@@ -1,4 +1,4 @@
-/* Execute this script as database owner */
+/* Execute this script as database owner to create the database and users */
 /* psql -h localhost -U postgres -p 5432 -f assets/deployment/database/schema.sql */
 
 drop database todolist;
@@ -19,24 +19,5 @@ grant select, insert, update, delete on all tables in schema public to todolist_
 alter default privileges in schema public grant all on tables to todolist_user;
 alter default privileges in schema public grant all on sequences to todolist_user;
 
-drop table tasks;
-
-create table tasks(
-   id serial primary key,
-   name varchar(50) not null,
-   description text,
-   category varchar(20) not null,
-   status varchar(10) not null,
-   duedate timestamp,
-   created timestamp not null default current_timestamp
-);
-create index tasks_status on tasks (status);
-
-
-
-
-
-
-
-
-
+/* tables are created by the application migrations */
+/* todolist migrate up --db-host localhost --db-user todolist_admin --db-password todo101 --db-name todolist */
@@ -21,4 +21,5 @@ go run $MAIN \
   --db-password $DB_PASSWORD \
   --db-name $DB_NAME \
   --log-formatter $LOG_FORMATTER \
-  --v $VERBOSITY \  
+  --v $VERBOSITY \
+  ${AUTH_TOKENS_FILE:+--auth-tokens-file $AUTH_TOKENS_FILE}
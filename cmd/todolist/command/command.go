@@ -5,6 +5,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/odacremolbap/rest-demo/cmd/todolist/command/common"
+	"github.com/odacremolbap/rest-demo/cmd/todolist/command/migrate"
 	"github.com/odacremolbap/rest-demo/cmd/todolist/command/server"
 	"github.com/spf13/cobra"
 )
@@ -45,6 +46,7 @@ func runHelp(cmd *cobra.Command, args []string) {
 func Execute() {
 	TODOCmd.SilenceUsage = true
 	TODOCmd.AddCommand(server.ServerCmd)
+	TODOCmd.AddCommand(migrate.MigrateCmd)
 	TODOCmd.AddCommand(VersionCmd)
 
 	if err := TODOCmd.Execute(); err != nil {
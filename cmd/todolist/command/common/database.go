@@ -0,0 +1,167 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+)
+
+// database drivers
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+var (
+	dbDriver   string
+	dbPath     string
+	dbHost     string
+	dbPort     int
+	dbUser     string
+	dbPassword string
+	dbName     string
+	dbSSL      bool
+
+	dbQueryTimeout    time.Duration
+	dbConnectTimeout  time.Duration
+	dbMaxOpenConns    int
+	dbMaxIdleConns    int
+	dbConnMaxLifetime time.Duration
+	dbReplicaDSN      string
+)
+
+// AddDatabaseFlags adds database connection flags to a command
+func AddDatabaseFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&dbDriver, "db-driver", driverPostgres, "database driver, one of postgres|sqlite")
+	flags.StringVar(&dbPath, "db-path", "", "database file path for sqlite driver")
+	flags.StringVar(&dbHost, "db-host", "", "database host")
+	flags.IntVar(&dbPort, "db-port", 5432, "database port")
+	flags.StringVar(&dbUser, "db-user", "", "database user")
+	flags.StringVar(&dbPassword, "db-password", "", "database password")
+	flags.StringVar(&dbName, "db-name", "", "database name")
+	flags.BoolVar(&dbSSL, "db-ssl", false, "set database SSL connection support")
+	flags.DurationVar(&dbQueryTimeout, "db-query-timeout", 30*time.Second, "maximum duration of each database operation, 0 for no limit")
+	flags.DurationVar(&dbConnectTimeout, "db-connect-timeout", time.Minute, "time to keep retrying the database connection at startup, 0 for a single attempt")
+	flags.IntVar(&dbMaxOpenConns, "db-max-open-conns", 10, "maximum open postgres connections, 0 for no limit")
+	flags.IntVar(&dbMaxIdleConns, "db-max-idle-conns", 2, "maximum idle postgres connections kept for reuse")
+	flags.DurationVar(&dbConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "maximum time a postgres connection is reused, 0 for no limit")
+}
+
+// AddReplicaFlags adds read replica connection flags to a command
+func AddReplicaFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&dbReplicaDSN, "db-replica-dsn", "", "postgres connection string for a read only replica serving task reads, e.g. \"host=replica user=todolist password=secret dbname=todolist sslmode=disable\"")
+}
+
+// ValidateDatabaseFlags checks database connection flags
+func ValidateDatabaseFlags() error {
+	if dbQueryTimeout < 0 {
+		return errors.New("database query timeout can't be negative")
+	}
+
+	if dbConnectTimeout < 0 {
+		return errors.New("database connect timeout can't be negative")
+	}
+
+	if dbMaxOpenConns < 0 || dbMaxIdleConns < 0 || dbConnMaxLifetime < 0 {
+		return errors.New("database connection pool limits can't be negative")
+	}
+
+	switch dbDriver {
+	case driverSQLite:
+		if len(dbReplicaDSN) != 0 {
+			return errors.New("read replicas are only supported for postgres")
+		}
+		if len(dbPath) == 0 {
+			return errors.New("a database path is needed")
+		}
+		return nil
+	case driverPostgres:
+	default:
+		return errors.Errorf("database driver must be one of %s|%s", driverPostgres, driverSQLite)
+	}
+
+	if len(dbHost) == 0 {
+		return errors.New("a database host is needed")
+	}
+
+	if len(dbUser) == 0 {
+		return errors.New("a database user is needed")
+	}
+
+	if len(dbName) == 0 {
+		return errors.New("a database instance name is needed")
+	}
+
+	return nil
+}
+
+// IsSQLite returns true when the configured driver is sqlite
+func IsSQLite() bool {
+	return dbDriver == driverSQLite
+}
+
+// ConnectDatabase returns a persistence manager for the configured driver
+func ConnectDatabase() (*db.PersistenceManager, error) {
+	if dbDriver == driverSQLite {
+		connDB, err := db.ConnectSQLiteDB(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		pm := db.NewSQLitePersistenceManager(connDB)
+		pm.SetQueryTimeout(dbQueryTimeout)
+		return pm, nil
+	}
+
+	connDB, err := connectWithTimeout(func() (*sql.DB, error) {
+		return db.ConnectPostgressDB(dbHost, dbPort, dbUser, dbPassword, dbName, dbSSL, poolOptions())
+	})
+	if err != nil {
+		return nil, err
+	}
+	pm := db.NewTODOPersistenceManager(connDB)
+	pm.SetQueryTimeout(dbQueryTimeout)
+
+	if len(dbReplicaDSN) == 0 {
+		return pm, nil
+	}
+	replicaDB, err := connectWithTimeout(func() (*sql.DB, error) {
+		return db.ConnectPostgresReplicaDB(dbReplicaDSN, poolOptions())
+	})
+	if err != nil {
+		_ = connDB.Close()
+		return nil, err
+	}
+	pm.SetReplica(replicaDB)
+	return pm, nil
+}
+
+// connectWithTimeout retries a database connection for up to the connect timeout,
+// each connection gets its own timeout
+func connectWithTimeout(connect func() (*sql.DB, error)) (*sql.DB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbConnectTimeout)
+	defer cancel()
+	return db.ConnectWithRetry(ctx, connect)
+}
+
+// poolOptions returns the configured connection pool options
+func poolOptions() db.PoolOptions {
+	return db.PoolOptions{
+		MaxOpenConns:    dbMaxOpenConns,
+		MaxIdleConns:    dbMaxIdleConns,
+		ConnMaxLifetime: dbConnMaxLifetime,
+	}
+}
+
+// ListenTaskEvents subscribes the persistence manager to task changes made
+// by other server instances. Only supported for postgres, no-op otherwise
+func ListenTaskEvents(pm *db.PersistenceManager) error {
+	if dbDriver != driverPostgres {
+		return nil
+	}
+	return pm.ListenTaskEvents(dbHost, dbPort, dbUser, dbPassword, dbName, dbSSL)
+}
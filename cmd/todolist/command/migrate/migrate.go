@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/odacremolbap/rest-demo/cmd/todolist/command/common"
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+)
+
+func init() {
+	common.AddDatabaseFlags(MigrateCmd.PersistentFlags())
+
+	MigrateCmd.AddCommand(upCmd)
+	MigrateCmd.AddCommand(downCmd)
+	MigrateCmd.AddCommand(statusCmd)
+}
+
+// MigrateCmd manages database schema migrations
+var MigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage database schema migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = cmd.Help()
+	},
+}
+
+var upCmd = &cobra.Command{
+	Use:   "up",
+	Short: "apply all pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		pm := connect(cmd)
+
+		done, err := pm.MigrateUp()
+		for _, m := range done {
+			fmt.Printf("applied\t%d\t%s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			log.Error(err, "")
+			os.Exit(-1)
+		}
+		if len(done) == 0 {
+			fmt.Println("database schema is up to date")
+		}
+	},
+}
+
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "revert the latest applied migration",
+	Run: func(cmd *cobra.Command, args []string) {
+		pm := connect(cmd)
+
+		m, err := pm.MigrateDown()
+		if err != nil {
+			log.Error(err, "")
+			os.Exit(-1)
+		}
+		if m == nil {
+			fmt.Println("no migrations to revert")
+			return
+		}
+		fmt.Printf("reverted\t%d\t%s\n", m.Version, m.Description)
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show migrations status",
+	Run: func(cmd *cobra.Command, args []string) {
+		pm := connect(cmd)
+
+		status, err := pm.MigrationsStatus()
+		if err != nil {
+			log.Error(err, "")
+			os.Exit(-1)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%-20s\t%s\n", s.Version, applied, s.Description)
+		}
+	},
+}
+
+// connect validates flags and connects to the database
+func connect(cmd *cobra.Command) *db.PersistenceManager {
+	if err := common.ValidateDatabaseFlags(); err != nil {
+		log.Error(err, "")
+		_ = cmd.Usage()
+		os.Exit(-1)
+	}
+
+	pm, err := common.ConnectDatabase()
+	if err != nil {
+		log.Error(err, "")
+		os.Exit(-1)
+	}
+	return pm
+}
@@ -1,39 +1,52 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/odacremolbap/rest-demo/cmd/todolist/command/common"
 	"github.com/odacremolbap/rest-demo/pkg/db"
 	"github.com/odacremolbap/rest-demo/pkg/log"
 	"github.com/odacremolbap/rest-demo/pkg/server"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
+// deletedPurgeInterval is how often deleted tasks past retention are purged
+const deletedPurgeInterval = 10 * time.Minute
+
+// storage backends
+const (
+	storageMemory   = "memory"
+	storagePostgres = "postgres"
+	// storageDatabase uses the database driver set at the database flags
+	storageDatabase = "database"
+)
+
 var (
-	serverPort      int
-	shutdownTimeout time.Duration
-
-	dbHost     string
-	dbPort     int
-	dbUser     string
-	dbPassword string
-	dbName     string
-	dbSSL      bool
+	serverPort       int
+	shutdownTimeout  time.Duration
+	storage          string
+	autoMigrate      bool
+	devTenantHeader  bool
+	authTokensFile   string
+	deletedRetention time.Duration
 )
 
 func init() {
 	ServerCmd.PersistentFlags().IntVar(&serverPort, "port", 8080, "insecure listen port")
 	ServerCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 10, "graceful shutdown timeout for API server")
-
-	ServerCmd.PersistentFlags().StringVar(&dbHost, "db-host", "", "database host")
-	ServerCmd.PersistentFlags().IntVar(&dbPort, "db-port", 5432, "database port")
-	ServerCmd.PersistentFlags().StringVar(&dbUser, "db-user", "", "database user")
-	ServerCmd.PersistentFlags().StringVar(&dbPassword, "db-password", "", "database password")
-	ServerCmd.PersistentFlags().StringVar(&dbName, "db-name", "", "database name")
-	ServerCmd.PersistentFlags().BoolVar(&dbSSL, "db-ssl", false, "set database SSL connection support")
+	ServerCmd.PersistentFlags().StringVar(&storage, "storage", storagePostgres, "tasks storage, one of memory|postgres|database. database uses the database driver set with --db-driver, such as sqlite")
+	ServerCmd.PersistentFlags().BoolVar(&autoMigrate, "auto-migrate", false, "apply pending database migrations at start")
+	ServerCmd.PersistentFlags().BoolVar(&devTenantHeader, "dev-tenant-header", false, "serve requests for the tenant at the X-Tenant header, for development only")
+	ServerCmd.PersistentFlags().StringVar(&authTokensFile, "auth-tokens-file", "", "file of tenant and bearer token pairs, one per line, requests are authenticated for the tenant of their token. If not set requests are served for the default tenant")
+	ServerCmd.PersistentFlags().DurationVar(&deletedRetention, "deleted-retention", 0, "time deleted tasks are kept before being permanently removed, 0 keeps them forever")
+
+	common.AddDatabaseFlags(ServerCmd.PersistentFlags())
+	common.AddReplicaFlags(ServerCmd.PersistentFlags())
 }
 
 // ServerCmd TODO list server command
@@ -50,34 +63,104 @@ var ServerCmd = &cobra.Command{
 			os.Exit(-1)
 		}
 
-		connDB, err := db.ConnectPostgressDB(dbHost, dbPort, dbUser, dbPassword, dbName, dbSSL)
-		if err != nil {
-			log.Error(err, "")
-			os.Exit(-1)
+		switch storage {
+		case storageMemory:
+			log.Info("using in memory storage, tasks will be lost on exit")
+			db.Manager = db.NewMemoryPersistenceManager()
+		case storagePostgres, storageDatabase:
+			pm, err := common.ConnectDatabase()
+			if err != nil {
+				log.Error(err, "")
+				os.Exit(-1)
+			}
+			// single node sqlite databases are always kept up to date
+			if err = checkSchema(pm, autoMigrate || common.IsSQLite()); err != nil {
+				log.Error(err, "")
+				os.Exit(-1)
+			}
+			// watchers receive changes from all server instances
+			if err = common.ListenTaskEvents(pm); err != nil {
+				log.Error(err, "")
+				os.Exit(-1)
+			}
+			db.Manager = pm
+		}
+
+		if purger, ok := db.Manager.(db.TaskPurger); ok && deletedRetention > 0 {
+			interval := deletedPurgeInterval
+			if deletedRetention < interval {
+				interval = deletedRetention
+			}
+			go db.RunTaskPurger(context.Background(), purger, deletedRetention, interval)
 		}
-		db.Manager = db.NewTODOPersistenceManager(connDB)
 
 		s := server.NewServer(serverPort, shutdownTimeout)
+		if devTenantHeader {
+			log.Info("tenant is read from request headers, do not use in production")
+			s.DevTenantHeader = true
+		}
+		if authTokensFile != "" {
+			tokens, err := tenant.ReadTokensFile(authTokensFile)
+			if err != nil {
+				log.Error(err, "")
+				os.Exit(-1)
+			}
+			s.Authenticator = tenant.TokenAuthenticator(tokens)
+		} else if !devTenantHeader {
+			log.Info("authentication is not configured, requests are served for the default tenant")
+		}
 
 		log.Info(fmt.Sprintf("listening on port %d", serverPort))
 		s.Run()
 	},
 }
 
-// validate server flags
-func validate() error {
+// checkSchema makes sure the database schema is not behind this binary
+func checkSchema(pm *db.PersistenceManager, migrate bool) error {
+	current, err := pm.CurrentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := db.SchemaVersion()
+	log.V(5).Info("checking database schema", "current", current, "latest", latest)
 
-	if len(dbHost) == 0 {
-		return errors.New("a database host is needed")
+	if current > latest {
+		log.Info("database schema is ahead of this binary",
+			"current", current,
+			"latest", latest)
+	}
+	if current >= latest {
+		return nil
 	}
 
-	if len(dbUser) == 0 {
-		return errors.New("a database user is needed")
+	if !migrate {
+		return errors.Errorf("database schema version %d is behind %d, execute migrations or use --auto-migrate",
+			current, latest)
 	}
+	_, err = pm.MigrateUp()
+	return err
+}
 
-	if len(dbName) == 0 {
-		return errors.New("a database instance name is needed")
+// validate server flags
+func validate() error {
+	if devTenantHeader && authTokensFile != "" {
+		return errors.New("dev-tenant-header can't be used with auth-tokens-file")
+	}
+	if deletedRetention < 0 {
+		return errors.New("deleted tasks retention can't be negative")
+	}
+
+	switch storage {
+	case storageMemory:
+		return nil
+	case storagePostgres:
+		if common.IsSQLite() {
+			return errors.Errorf("%s storage can't use the sqlite driver, use %s storage instead", storagePostgres, storageDatabase)
+		}
+	case storageDatabase:
+	default:
+		return errors.Errorf("storage must be one of %s|%s|%s", storageMemory, storagePostgres, storageDatabase)
 	}
 
-	return nil
+	return common.ValidateDatabaseFlags()
 }
@@ -0,0 +1,253 @@
+package clauses
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Allowlists keep the fields of a resource type that requests can
+// filter, sort and project listings by
+type Allowlists struct {
+	Where  []AllowedWhere
+	Order  []AllowedOrder
+	Fields []AllowedField
+}
+
+// filterTypes are the supported AllowedWhere types
+var filterTypes = map[string]bool{
+	"string": true, "integer": true, "boolean": true, "timestamp": true, "presence": true,
+}
+
+// AllowlistsFromType builds the allowlists of a struct type from its
+// field tags. Only fields with a db tag naming their DB field are used:
+// - json names the field at responses, and can be requested for projection
+// - filter lists the filters on the field separated by semicolons. Each
+// filter is its name at requests followed by comma separated options:
+// type, one of AllowedWhere types, inferred from the Go type if not set;
+// ops, the allowed FilterOperators separated by |, only eq if not set;
+// cmp, the comparison replacing equality, as in
+// `filter:"due_before,type=timestamp,cmp=<;has_due_date,type=presence"`
+// - sort names the field for ordering, pointer fields are nullable
+func AllowlistsFromType(v interface{}) (*Allowlists, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, errors.Errorf("allowlists need a struct type, got %v", t)
+	}
+
+	a := &Allowlists{}
+	urlFields := map[string]bool{}
+	sortFields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		dbField := f.Tag.Get("db")
+		if dbField == "" {
+			continue
+		}
+
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			a.Fields = append(a.Fields, AllowedField{URLField: name, DBField: dbField})
+		}
+
+		if sort := f.Tag.Get("sort"); sort != "" {
+			if sortFields[sort] {
+				return nil, errors.Errorf("field %s sort %s is already defined", f.Name, sort)
+			}
+			sortFields[sort] = true
+			a.Order = append(a.Order, AllowedOrder{
+				URLField: sort,
+				DBField:  dbField,
+				Type:     inferFilterType(f.Type),
+				Nullable: f.Type.Kind() == reflect.Ptr,
+			})
+		}
+
+		filter := f.Tag.Get("filter")
+		if filter == "" {
+			continue
+		}
+		for _, spec := range strings.Split(filter, ";") {
+			w, err := parseFilterTag(spec, dbField, f.Type)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s filter tag", f.Name)
+			}
+			if urlFields[w.URLField] {
+				return nil, errors.Errorf("field %s filter %s is already defined", f.Name, w.URLField)
+			}
+			urlFields[w.URLField] = true
+			a.Where = append(a.Where, w)
+		}
+	}
+	return a, nil
+}
+
+// MustAllowlistsFromType is like AllowlistsFromType but panics
+// if tags can't be parsed, for package level allowlists
+func MustAllowlistsFromType(v interface{}) *Allowlists {
+	a, err := AllowlistsFromType(v)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// parseFilterTag parses a filter of a filter tag
+func parseFilterTag(spec, dbField string, goType reflect.Type) (AllowedWhere, error) {
+	options := strings.Split(spec, ",")
+	w := AllowedWhere{
+		URLField: strings.TrimSpace(options[0]),
+		DBField:  dbField,
+		Type:     inferFilterType(goType),
+	}
+	if w.URLField == "" {
+		return w, errors.Errorf("filter %q has no name", spec)
+	}
+
+	for _, o := range options[1:] {
+		kv := strings.SplitN(strings.TrimSpace(o), "=", 2)
+		if len(kv) != 2 {
+			return w, errors.Errorf("filter %s option %q is not a key=value pair", w.URLField, o)
+		}
+		switch kv[0] {
+		case "type":
+			w.Type = kv[1]
+		case "ops":
+			w.Operators = strings.Split(kv[1], "|")
+		case "cmp":
+			w.Comparison = kv[1]
+		default:
+			return w, errors.Errorf("filter %s has unknown option %s", w.URLField, kv[0])
+		}
+	}
+
+	if !filterTypes[w.Type] {
+		return w, errors.Errorf("filter %s has unknown type %q", w.URLField, w.Type)
+	}
+	for _, op := range w.Operators {
+		if filterOperator(op).Name == "" {
+			return w, errors.Errorf("filter %s has unknown operator %s", w.URLField, op)
+		}
+	}
+	if w.Comparison != "" && !supportedComparison(w.Comparison) {
+		return w, errors.Errorf("filter %s has unsupported comparison %s", w.URLField, w.Comparison)
+	}
+	return w, nil
+}
+
+// inferFilterType returns the filter type of a Go type,
+// an empty type if it can't be inferred
+func inferFilterType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "timestamp"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	}
+	return ""
+}
+
+// QueryParameter documents a query string parameter
+type QueryParameter struct {
+	Name        string
+	Description string
+	DataType    string
+}
+
+// FilterParameters documents the filter query parameters, one for
+// each allowed filter and operator, and the filter expression
+func (a *Allowlists) FilterParameters() []QueryParameter {
+	params := []QueryParameter{}
+	for _, w := range a.Where {
+		for _, op := range FilterOperators {
+			if !w.Allows(op.Name) {
+				continue
+			}
+			params = append(params, QueryParameter{
+				Name:        FilterParameter(w.URLField, op.Name),
+				Description: filterDescription(w, op),
+				DataType:    filterDataType(w, op),
+			})
+		}
+	}
+	return append(params, QueryParameter{
+		Name: FilterQuery,
+		Description: "filter expression combining filter fields, as in (field==a,field==b);other!=c. " +
+			"Comparisons are ==, !=, =gt=, =gte=, =lt=, =lte=, =in= with a parenthesized list and =like=, " +
+			"; or and match all comparisons, and , or or match any",
+		DataType: "string",
+	})
+}
+
+// OrderParameter documents the order query parameter
+func (a *Allowlists) OrderParameter() QueryParameter {
+	names := make([]string, len(a.Order))
+	for i, o := range a.Order {
+		names[i] = o.URLField
+	}
+	return QueryParameter{
+		Name: OrderByQuery,
+		Description: fmt.Sprintf("comma separated values %v, each followed by :asc or :desc "+
+			"and :nullsfirst or :nullslast, as in due_date:asc:nullslast. "+
+			"Results are always sorted by id last", names),
+		DataType: "string",
+	}
+}
+
+// FieldsParameter documents the fields query parameter
+func (a *Allowlists) FieldsParameter() QueryParameter {
+	names := make([]string, len(a.Fields))
+	for i, f := range a.Fields {
+		names[i] = f.URLField
+	}
+	return QueryParameter{
+		Name:        FieldsQuery,
+		Description: fmt.Sprintf("comma separated fields to return out of %v, all of them if not set", names),
+		DataType:    "string",
+	}
+}
+
+// filterDescription returns the description of a filter parameter
+func filterDescription(w AllowedWhere, op FilterOperator) string {
+	if w.Type == "presence" {
+		return fmt.Sprintf("filter by %s being set or not", w.DBField)
+	}
+
+	description := fmt.Sprintf("filter by %s %s", w.URLField, op.Description)
+	if w.Comparison != "" && op.Name == OperatorEq {
+		for _, o := range FilterOperators {
+			if o.Comparison == w.Comparison {
+				description = fmt.Sprintf("filter by %s %s the value", w.DBField, o.Description)
+			}
+		}
+	}
+	if w.Type == "timestamp" {
+		description += ", as a RFC3339 time, a date or a time relative to now such as now-7d"
+	}
+	return description
+}
+
+// filterDataType returns the data type of a filter parameter
+func filterDataType(w AllowedWhere, op FilterOperator) string {
+	switch {
+	case w.Type == "presence":
+		return "boolean"
+	case w.Type == "timestamp", op.Name == OperatorIn:
+		return "string"
+	}
+	return w.Type
+}
@@ -3,6 +3,9 @@ package clauses
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestPaginationClause(t *testing.T) {
@@ -33,63 +36,122 @@ func TestPaginationClause(t *testing.T) {
 	}
 }
 
+// allowedOrderFields returns non nullable order fields named as their DB fields
+func allowedOrderFields(names ...string) []AllowedOrder {
+	allowed := make([]AllowedOrder, len(names))
+	for i, n := range names {
+		allowed[i] = AllowedOrder{URLField: n, DBField: n, Type: "string"}
+	}
+	return allowed
+}
+
 func TestOrderByClause(t *testing.T) {
+	nullable := append(allowedOrderFields("field1"),
+		AllowedOrder{URLField: "due", DBField: "due_at", Type: "timestamp", Nullable: true})
 
 	var sortTests = []struct {
 		values         map[string]string
-		allowedOrderBy []string
+		allowedOrderBy []AllowedOrder
 		expectedClause string
 		expectedErr    bool
 	}{
 		{
 			map[string]string{"order": "field1"},
-			[]string{"field1"},
+			allowedOrderFields("field1"),
 			"field1",
 			false,
 		},
 		{
 			map[string]string{"order": "field1:asc"},
-			[]string{"field1"},
+			allowedOrderFields("field1"),
 			"field1 asc",
 			false,
 		},
 		{
 			map[string]string{"order": "field1,field2"},
-			[]string{"field1"},
+			allowedOrderFields("field1"),
 			"",
 			true,
 		},
 		{
 			map[string]string{"order": "field1,field2"},
-			[]string{"field1", "field2", "field3"},
+			allowedOrderFields("field1", "field2", "field3"),
 			"field1,field2",
 			false,
 		},
 		{
 			map[string]string{"order": "field1,field3,field2"},
-			[]string{"field1", "field2", "field3"},
+			allowedOrderFields("field1", "field2", "field3"),
 			"field1,field3,field2",
 			false,
 		},
 		{
 			map[string]string{"order": "field1,field4,field2"},
-			[]string{"field1", "field2", "field3"},
+			allowedOrderFields("field1", "field2", "field3"),
 			"",
 			true,
 		},
 		{
 			map[string]string{"order": "field1:desc,field3:asc,field2:desc"},
-			[]string{"field1", "field2", "field3"},
+			allowedOrderFields("field1", "field2", "field3"),
 			"field1 desc,field3 asc,field2 desc",
 			false,
 		},
+		{
+			map[string]string{"order": "due"},
+			nullable,
+			"due_at nulls last",
+			false,
+		},
+		{
+			map[string]string{"order": "due:desc,field1"},
+			nullable,
+			"due_at desc nulls first,field1",
+			false,
+		},
+		{
+			map[string]string{"order": "due:asc:nullsfirst"},
+			nullable,
+			"due_at asc nulls first",
+			false,
+		},
+		{
+			map[string]string{"order": "due:nullslast,field1:desc:nullsfirst"},
+			nullable,
+			"due_at nulls last,field1 desc nulls first",
+			false,
+		},
+		{
+			map[string]string{"order": "due_at"},
+			nullable,
+			"",
+			true,
+		},
+		{
+			map[string]string{"order": "due:nullslast:asc"},
+			nullable,
+			"",
+			true,
+		},
+		{
+			map[string]string{"order": "due:asc:desc"},
+			nullable,
+			"",
+			true,
+		},
+		{
+			map[string]string{"order": "due:nulls"},
+			nullable,
+			"",
+			true,
+		},
 	}
 
 	for i, st := range sortTests {
 		t.Run(fmt.Sprintf("sort test %d, size %+v", i, st.values),
 			func(t *testing.T) {
-				out, err := OrderByClauseFromRequest(st.values, st.allowedOrderBy)
-				if out != st.expectedClause {
+				items, err := OrderItemsFromRequest(st.values, st.allowedOrderBy)
+				if out := OrderByClause(items); out != st.expectedClause {
 					t.Errorf("got %q, wanted %q", out, st.expectedClause)
 				}
 				if (err != nil) != st.expectedErr {
@@ -99,3 +161,484 @@ func TestOrderByClause(t *testing.T) {
 			})
 	}
 }
+
+func TestFilterOperators(t *testing.T) {
+	allowedWhere := []AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer", Operators: []string{"eq", "gt", "in"}},
+		{URLField: "name", DBField: "task_name", Type: "string", Operators: []string{"ne", "like"}},
+		{URLField: "status", DBField: "status", Type: "string"},
+		{URLField: "due_before", DBField: "duedate", Type: "timestamp", Comparison: "<"},
+		{URLField: "has_due_date", DBField: "duedate", Type: "presence"},
+	}
+
+	var filterTests = []struct {
+		values         map[string]string
+		expectedClause string
+		expectedParams string
+		expectedErr    bool
+	}{
+		{
+			map[string]string{"id": "3", "status": "pending"},
+			"id = $1 and status = $2",
+			"[3 pending]",
+			false,
+		},
+		{
+			map[string]string{"id[gt]": "3", "id[in]": "4,5", "name[ne]": "a"},
+			"id > $1 and id in ($2, $3) and task_name <> $4",
+			"[3 4 5 a]",
+			false,
+		},
+		{
+			map[string]string{"name[like]": `buy*100%`},
+			`task_name like $1 escape '\'`,
+			`[buy%100\%]`,
+			false,
+		},
+		{
+			map[string]string{"id[in]": "4,x"},
+			"",
+			"[]",
+			true,
+		},
+		{
+			map[string]string{"name": "a"},
+			"",
+			"[]",
+			false,
+		},
+		{
+			map[string]string{"status[ne]": "pending"},
+			"",
+			"[]",
+			true,
+		},
+		{
+			map[string]string{"id[unknown]": "3"},
+			"",
+			"[]",
+			true,
+		},
+		{
+			map[string]string{"due_before": "2030-01-02", "has_due_date": "true"},
+			"duedate < $1 and duedate is not null",
+			"[2030-01-02 00:00:00 +0000 UTC]",
+			false,
+		},
+		{
+			map[string]string{"has_due_date": "false"},
+			"duedate is null",
+			"[]",
+			false,
+		},
+		{
+			map[string]string{"due_before": "soon"},
+			"",
+			"[]",
+			true,
+		},
+	}
+
+	for i, ft := range filterTests {
+		t.Run(fmt.Sprintf("filter test %d, values %v", i, ft.values),
+			func(t *testing.T) {
+				out, params, err := WhereClauseFromRequest(ft.values, allowedWhere)
+				if out != ft.expectedClause {
+					t.Errorf("got %q, wanted %q", out, ft.expectedClause)
+				}
+				if err == nil && fmt.Sprint(params) != ft.expectedParams {
+					t.Errorf("got params %v, wanted %s", params, ft.expectedParams)
+				}
+				if (err != nil) != ft.expectedErr {
+					t.Logf("got error: %s", err)
+					t.Errorf("got %t, wanted %t", err != nil, ft.expectedErr)
+				}
+			})
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	allowedWhere := []AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer", Operators: []string{"eq", "gt", "in"}},
+		{URLField: "name", DBField: "task_name", Type: "string", Operators: []string{"eq", "like"}},
+		{URLField: "status", DBField: "status", Type: "string", Operators: []string{"eq", "ne", "in"}},
+		{URLField: "category", DBField: "category", Type: "string", Operators: []string{"eq", "ne"}},
+		{URLField: "has_due_date", DBField: "duedate", Type: "presence"},
+	}
+
+	var expressionTests = []struct {
+		values           map[string]string
+		expectedClause   string
+		expectedParams   string
+		expectedPosition int
+	}{
+		{
+			map[string]string{"filter": "(status==pending,status==started);category!=archive"},
+			"(status = $1 or status = $2) and category <> $3",
+			"[pending started archive]",
+			0,
+		},
+		{
+			map[string]string{"filter": "status==pending or status==started and category!=archive"},
+			"(status = $1 or (status = $2 and category <> $3))",
+			"[pending started archive]",
+			0,
+		},
+		{
+			map[string]string{"filter": "id=gt=3 ; status=in=(pending, 'started') ; name=like='buy milk*'", "category": "home"},
+			"category = $1 and (id > $2 and status in ($3, $4) and task_name like $5 escape '\\')",
+			"[home 3 pending started buy milk%]",
+			0,
+		},
+		{
+			map[string]string{"filter": `name=="say \"hi\", (or not)",has_due_date==false`},
+			"(task_name = $1 or duedate is null)",
+			`[say "hi", (or not)]`,
+			0,
+		},
+		{
+			map[string]string{"filter": "((id==1))"},
+			"id = $1",
+			"[1]",
+			0,
+		},
+		{map[string]string{"filter": "status==pending;"}, "", "", 17},
+		{map[string]string{"filter": "status==pending)"}, "", "", 16},
+		{map[string]string{"filter": "(status==pending"}, "", "", 1},
+		{map[string]string{"filter": "owner==me"}, "", "", 1},
+		{map[string]string{"filter": "status==pending;category=gt=a"}, "", "", 25},
+		{map[string]string{"filter": "status=unknown=a"}, "", "", 7},
+		{map[string]string{"filter": "status pending"}, "", "", 8},
+		{map[string]string{"filter": "id=in=(1,two)"}, "", "", 10},
+		{map[string]string{"filter": "id==(1,2)"}, "", "", 5},
+		{map[string]string{"filter": "name=='buy"}, "", "", 7},
+		{map[string]string{"filter": "status==pending status==started"}, "", "", 17},
+	}
+
+	for i, et := range expressionTests {
+		t.Run(fmt.Sprintf("expression test %d, values %v", i, et.values),
+			func(t *testing.T) {
+				q, err := BuildQueryClauseFromRequest(et.values, allowedWhere, nil)
+				if et.expectedPosition != 0 {
+					ferr, ok := errors.Cause(err).(*FilterError)
+					if !ok {
+						t.Fatalf("got error %v, wanted a filter error", err)
+					}
+					if ferr.Position != et.expectedPosition {
+						t.Errorf("got error %q at position %d, wanted position %d",
+							ferr.Message, ferr.Position, et.expectedPosition)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if q.Where != et.expectedClause {
+					t.Errorf("got %q, wanted %q", q.Where, et.expectedClause)
+				}
+				if fmt.Sprint(q.WhereParams) != et.expectedParams {
+					t.Errorf("got params %v, wanted %s", q.WhereParams, et.expectedParams)
+				}
+			})
+	}
+}
+
+func TestFieldsFromRequest(t *testing.T) {
+	allowedFields := []AllowedField{
+		{URLField: "id", DBField: "id"},
+		{URLField: "name", DBField: "name"},
+		{URLField: "due_date", DBField: "duedate"},
+	}
+
+	var fieldsTests = []struct {
+		values         map[string]string
+		expectedFields string
+		expectedErr    bool
+	}{
+		{map[string]string{}, "[]", false},
+		{map[string]string{"fields": "name"}, "[{name name}]", false},
+		{map[string]string{"fields": "due_date, id,due_date"}, "[{due_date duedate} {id id}]", false},
+		{map[string]string{"fields": "name,owner"}, "[]", true},
+		{map[string]string{"fields": "name,"}, "[]", true},
+	}
+
+	for _, ft := range fieldsTests {
+		t.Run(fmt.Sprintf("fields %v", ft.values),
+			func(t *testing.T) {
+				fields, err := FieldsFromRequest(ft.values, allowedFields)
+				if (err != nil) != ft.expectedErr {
+					t.Errorf("got error %v, wanted %t", err, ft.expectedErr)
+				}
+				if fmt.Sprint(fields) != ft.expectedFields {
+					t.Errorf("got %v, wanted %s", fields, ft.expectedFields)
+				}
+			})
+	}
+}
+
+func TestAllowlistsFromType(t *testing.T) {
+	type item struct {
+		ID       int        `json:"id" db:"id" filter:"id,ops=eq|in" sort:"id"`
+		Title    string     `json:"title,omitempty" db:"item_title" filter:"title,ops=like"`
+		Done     bool       `json:"done" db:"done" filter:"done"`
+		Due      *time.Time `json:"due" db:"due_at" filter:"due_before,cmp=<;has_due,type=presence" sort:"due"`
+		Internal string     `json:"-" db:"internal"`
+		Computed string     `json:"computed"`
+	}
+
+	a, err := AllowlistsFromType(&item{})
+	if err != nil {
+		t.Fatalf("building allowlists: %v", err)
+	}
+	expectedWhere := "[{id id integer [eq in] } {title item_title string [like] } {done done boolean [] } " +
+		"{due_before due_at timestamp [] <} {has_due due_at presence [] }]"
+	if fmt.Sprint(a.Where) != expectedWhere {
+		t.Errorf("got where %v, wanted %s", a.Where, expectedWhere)
+	}
+	expectedOrder := "[{id id integer false} {due due_at timestamp true}]"
+	if fmt.Sprint(a.Order) != expectedOrder {
+		t.Errorf("got order %v, wanted %s", a.Order, expectedOrder)
+	}
+	expectedFields := "[{id id} {title item_title} {done done} {due due_at}]"
+	if fmt.Sprint(a.Fields) != expectedFields {
+		t.Errorf("got fields %v, wanted %s", a.Fields, expectedFields)
+	}
+
+	names := []string{}
+	for _, p := range a.FilterParameters() {
+		names = append(names, p.Name+":"+p.DataType)
+	}
+	expectedParams := "[id:integer id[in]:string title[like]:string done:boolean " +
+		"due_before:string has_due:boolean filter:string]"
+	if fmt.Sprint(names) != expectedParams {
+		t.Errorf("got parameters %v, wanted %s", names, expectedParams)
+	}
+
+	var errorTests = []interface{}{
+		"not a struct",
+		struct {
+			Name string `db:"name" filter:"name,ops=eq|unknown"`
+		}{},
+		struct {
+			Name string `db:"name" filter:"name,type=text"`
+		}{},
+		struct {
+			Name string `db:"name" filter:"name,cmp=~"`
+		}{},
+		struct {
+			Name string `db:"name" filter:"name,ops"`
+		}{},
+		struct {
+			Name string `db:"name" filter:"name;name"`
+		}{},
+		struct {
+			Tags []string `db:"tags" filter:"tags"`
+		}{},
+		struct {
+			Name  string `db:"name" sort:"name"`
+			Title string `db:"title" sort:"name"`
+		}{},
+	}
+	for i, et := range errorTests {
+		if _, err := AllowlistsFromType(et); err == nil {
+			t.Errorf("got no error for type %d %T", i, et)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Date(2019, 5, 10, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	var timestampTests = []struct {
+		value       string
+		expected    string
+		expectedErr bool
+	}{
+		{"now", "2019-05-10T10:30:00Z", false},
+		{"now-7d", "2019-05-03T10:30:00Z", false},
+		{"now+2h", "2019-05-10T12:30:00Z", false},
+		{"now-1w", "2019-05-03T10:30:00Z", false},
+		{"now-30m", "2019-05-10T10:00:00Z", false},
+		{"2019-05-01T10:00:00+02:00", "2019-05-01T08:00:00Z", false},
+		{"2019-05-01", "2019-05-01T00:00:00Z", false},
+		{"now-7y", "", true},
+		{"yesterday", "", true},
+	}
+
+	for _, tt := range timestampTests {
+		t.Run(fmt.Sprintf("timestamp %s", tt.value),
+			func(t *testing.T) {
+				out, err := ParseTimestamp(tt.value, now)
+				if (err != nil) != tt.expectedErr {
+					t.Errorf("got error %v, wanted %t", err, tt.expectedErr)
+				}
+				if err == nil && out.Format(time.RFC3339) != tt.expected {
+					t.Errorf("got %s, wanted %s", out.Format(time.RFC3339), tt.expected)
+				}
+			})
+	}
+}
+
+// cursorValues returns cursor values, empty strings are nulls
+func cursorValues(values ...string) []*string {
+	cv := make([]*string, len(values))
+	for i := range values {
+		if values[i] != "" {
+			cv[i] = &values[i]
+		}
+	}
+	return cv
+}
+
+func TestKeysetClause(t *testing.T) {
+	var keysetTests = []struct {
+		items          []OrderItem
+		values         []*string
+		start          int
+		expectedClause string
+		expectedParams []interface{}
+		expectedErr    bool
+	}{
+		{
+			[]OrderItem{{Field: "id"}},
+			cursorValues("3"),
+			1,
+			"((id > $1))",
+			[]interface{}{"3"},
+			false,
+		},
+		{
+			[]OrderItem{{Field: "name", Sort: "desc"}, {Field: "id", Type: "integer"}},
+			cursorValues("b", "3"),
+			2,
+			"((name < $2) or (name = $2 and id > $3))",
+			[]interface{}{"b", 3},
+			false,
+		},
+		{
+			[]OrderItem{{Field: "due", Nulls: "last", Type: "timestamp"}, {Field: "id", Type: "integer"}},
+			cursorValues("2030-01-02T15:04:05Z", "3"),
+			1,
+			"(((due > $1 or due is null)) or (due = $1 and id > $2))",
+			[]interface{}{time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC), 3},
+			false,
+		},
+		{
+			[]OrderItem{{Field: "due", Nulls: "last"}, {Field: "id"}},
+			cursorValues("", "3"),
+			1,
+			"((due is null and id > $1))",
+			[]interface{}{"3"},
+			false,
+		},
+		{
+			[]OrderItem{{Field: "due", Sort: "desc", Nulls: "first"}, {Field: "id"}},
+			cursorValues("", "3"),
+			1,
+			"((due is not null) or (due is null and id > $1))",
+			[]interface{}{"3"},
+			false,
+		},
+		{
+			[]OrderItem{{Field: "due", Sort: "desc", Nulls: "first"}, {Field: "name"}, {Field: "id"}},
+			cursorValues("2030-01-02", "", "3"),
+			4,
+			"",
+			nil,
+			true,
+		},
+		{
+			[]OrderItem{{Field: "due", Nulls: "last"}},
+			cursorValues(""),
+			1,
+			"",
+			nil,
+			true,
+		},
+		{
+			[]OrderItem{{Field: "due", Type: "timestamp"}, {Field: "id"}},
+			cursorValues("tomorrow", "3"),
+			1,
+			"",
+			nil,
+			true,
+		},
+		{
+			[]OrderItem{{Field: "name", Sort: "asc"}, {Field: "id"}},
+			cursorValues("b"),
+			1,
+			"",
+			nil,
+			true,
+		},
+		{
+			nil,
+			nil,
+			1,
+			"",
+			nil,
+			true,
+		},
+	}
+
+	for i, kt := range keysetTests {
+		t.Run(fmt.Sprintf("keyset test %d, items %v", i, kt.items),
+			func(t *testing.T) {
+				out, params, err := KeysetClause(kt.items, kt.values, kt.start)
+				if (err != nil) != kt.expectedErr {
+					t.Errorf("got error %v, wanted %t", err, kt.expectedErr)
+				}
+				if err != nil {
+					return
+				}
+				if out != kt.expectedClause {
+					t.Errorf("got %q, wanted %q", out, kt.expectedClause)
+				}
+				if fmt.Sprint(params) != fmt.Sprint(kt.expectedParams) {
+					t.Errorf("got params %v, wanted %v", params, kt.expectedParams)
+				}
+			})
+	}
+}
+
+func TestCursorFromRequest(t *testing.T) {
+	items := []OrderItem{{Field: "name", Sort: "desc"}, {Field: "id"}}
+	cursor, err := EncodeCursor(items, cursorValues("b", "3"))
+	if err != nil {
+		t.Fatalf("encoding cursor: %v", err)
+	}
+
+	var cursorTests = []struct {
+		values        map[string]string
+		expectedWhere string
+		expectedErr   bool
+	}{
+		{map[string]string{"order": "name:desc", "cursor": cursor}, "((name < $1) or (name = $1 and id > $2))", false},
+		{map[string]string{"order": "name:desc", "status": "pending", "cursor": cursor}, "status = $1 and ((name < $2) or (name = $2 and id > $3))", false},
+		{map[string]string{"order": "name", "cursor": cursor}, "", true},
+		{map[string]string{"order": "name:desc", "page": "2", "cursor": cursor}, "", true},
+		{map[string]string{"order": "name:desc", "cursor": "not a cursor"}, "", true},
+	}
+
+	for _, ct := range cursorTests {
+		t.Run(fmt.Sprintf("cursor %+v", ct.values),
+			func(t *testing.T) {
+				q, err := BuildQueryClauseFromRequest(
+					ct.values,
+					[]AllowedWhere{{URLField: "status", DBField: "status", Type: "string"}},
+					allowedOrderFields("name"))
+				if (err != nil) != ct.expectedErr {
+					t.Fatalf("got error %v, wanted %t", err, ct.expectedErr)
+				}
+				if err != nil {
+					return
+				}
+				if q.Where != ct.expectedWhere {
+					t.Errorf("got %q, wanted %q", q.Where, ct.expectedWhere)
+				}
+				if q.OrderByClause != "name desc,id" {
+					t.Errorf("got order %q, wanted tie breaker", q.OrderByClause)
+				}
+			})
+	}
+}
@@ -0,0 +1,48 @@
+package clauses
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Cursor points to the last item of a listing page, next
+// page starts right after it.
+// Values contains the item values for each order field,
+// nil for null values. Order keeps the order the cursor was created for
+type Cursor struct {
+	Order  string    `json:"o"`
+	Values []*string `json:"v"`
+}
+
+// EncodeCursor returns an opaque cursor string for the order items
+// and the last listed item values for each of them
+func EncodeCursor(items []OrderItem, values []*string) (string, error) {
+	if len(items) != len(values) {
+		return "", errors.Errorf("cursor has %d values for %d order fields",
+			len(values), len(items))
+	}
+	b, err := json.Marshal(Cursor{Order: OrderByClause(items), Values: values})
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeCursor parses an opaque cursor string, checking that
+// it was created for the order items
+func DecodeCursor(cursor string, items []OrderItem) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding cursor")
+	}
+	c := &Cursor{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrap(err, "error decoding cursor")
+	}
+	if c.Order != OrderByClause(items) || len(c.Values) != len(items) {
+		return nil, errors.New("cursor doesn't match the requested order")
+	}
+	return c, nil
+}
@@ -0,0 +1,403 @@
+package clauses
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// FilterQuery at query string
+const FilterQuery = "filter"
+
+// Filter expression logical operators
+const (
+	ExpressionAnd = "and"
+	ExpressionOr  = "or"
+)
+
+// FilterExpression is a node of a parsed filter expression. Comparisons
+// have a Filter, other nodes combine their Operands using Logic
+type FilterExpression struct {
+	Logic    string
+	Operands []*FilterExpression
+	Filter   *FilterItem
+}
+
+// FilterError is a filter expression parsing error,
+// Position is the 1-based character the error was found at
+type FilterError struct {
+	Position int
+	Message  string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+// expressionComparisons maps RSQL comparison aliases to filter operators,
+// besides =<operator>= for any of FilterOperators
+var expressionComparisons = map[string]string{
+	"==":   OperatorEq,
+	"!=":   OperatorNe,
+	">":    OperatorGt,
+	">=":   OperatorGte,
+	"<":    OperatorLt,
+	"<=":   OperatorLte,
+	"=ge=": OperatorGte,
+	"=le=": OperatorLte,
+}
+
+// reservedCharacters can't be used at field names or unquoted values
+const reservedCharacters = `"'();,=!<> `
+
+// ParseFilterExpression parses a RSQL/FIQL style filter expression
+// restricted to the allowed fields and operators:
+// - comparisons are written as field==value, field!=value, field=gt=value,
+// or any of FilterOperators as field=operator=value
+// - in comparisons take a list of values: status=in=(pending,started)
+// - values containing reserved characters or spaces are quoted: name=='buy milk'
+// - ; or and join comparisons that must all match,
+// , or or join comparisons where any must match, and takes precedence over or
+// - parentheses group comparisons
+func ParseFilterExpression(expression string, allowedWhere []AllowedWhere) (*FilterExpression, error) {
+	p := &filterParser{input: expression, allowedWhere: allowedWhere}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(p.input) {
+		if p.peek() == ')' {
+			return nil, p.errorf(p.pos, "unexpected closing parenthesis")
+		}
+		return nil, p.errorf(p.pos, "expected ; or , between comparisons")
+	}
+	return e, nil
+}
+
+// filterParser is a recursive descent parser for filter expressions
+type filterParser struct {
+	input        string
+	pos          int
+	allowedWhere []AllowedWhere
+}
+
+func (p *filterParser) errorf(pos int, format string, args ...interface{}) error {
+	return &FilterError{
+		Position: utf8.RuneCountInString(p.input[:pos]) + 1,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// peek returns the next byte, 0 at the end of the input
+func (p *filterParser) peek() byte {
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *filterParser) skipSpaces() {
+	for p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+// consumeLogic consumes a logical operator symbol or keyword if next
+func (p *filterParser) consumeLogic(symbol byte, keyword string) bool {
+	p.skipSpaces()
+	if p.peek() == symbol {
+		p.pos++
+		return true
+	}
+	// keywords must be surrounded by spaces or parentheses
+	end := p.pos + len(keyword)
+	if p.pos == 0 || p.input[p.pos-1] != ' ' ||
+		!strings.HasPrefix(p.input[p.pos:], keyword) ||
+		end == len(p.input) || (p.input[end] != ' ' && p.input[end] != '(') {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// parseOr parses comparisons or groups joined by , or or
+func (p *filterParser) parseOr() (*FilterExpression, error) {
+	return p.parseLogic(ExpressionOr, ',', p.parseAnd)
+}
+
+// parseAnd parses comparisons or groups joined by ; or and
+func (p *filterParser) parseAnd() (*FilterExpression, error) {
+	return p.parseLogic(ExpressionAnd, ';', p.parseTerm)
+}
+
+func (p *filterParser) parseLogic(logic string, symbol byte, operand func() (*FilterExpression, error)) (*FilterExpression, error) {
+	e, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	operands := []*FilterExpression{e}
+	for p.consumeLogic(symbol, logic) {
+		e, err = operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, e)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &FilterExpression{Logic: logic, Operands: operands}, nil
+}
+
+// parseTerm parses a parenthesized group or a comparison
+func (p *filterParser) parseTerm() (*FilterExpression, error) {
+	p.skipSpaces()
+	if p.peek() != '(' {
+		return p.parseComparison()
+	}
+	open := p.pos
+	p.pos++
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.peek() != ')' {
+		if p.pos == len(p.input) {
+			return nil, p.errorf(open, "unclosed parenthesis")
+		}
+		return nil, p.errorf(p.pos, "expected ; , or closing parenthesis")
+	}
+	p.pos++
+	return e, nil
+}
+
+// parseComparison parses field, operator and arguments
+// and checks them against the allowed fields
+func (p *filterParser) parseComparison() (*FilterExpression, error) {
+	fieldPos := p.pos
+	field := p.readUnreserved()
+	if field == "" {
+		if p.pos == len(p.input) {
+			return nil, p.errorf(p.pos, "unexpected end of filter, expected field name")
+		}
+		return nil, p.errorf(p.pos, "expected field name")
+	}
+	allowed, ok := p.allowedField(field)
+	if !ok {
+		return nil, p.errorf(fieldPos, "field %s is not allowed for filtering", field)
+	}
+
+	p.skipSpaces()
+	opPos := p.pos
+	operator, err := p.readOperator()
+	if err != nil {
+		return nil, err
+	}
+	if !allowed.Allows(operator.Name) {
+		return nil, p.errorf(opPos, "operator %s is not allowed for field %s", operator.Name, field)
+	}
+
+	p.skipSpaces()
+	argsPos := p.pos
+	args, positions, err := p.readArguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 1 && operator.Name != OperatorIn {
+		return nil, p.errorf(argsPos, "operator %s takes a single value", operator.Name)
+	}
+
+	for i, a := range args {
+		if _, err := filterValue(allowed, a); err != nil {
+			return nil, p.errorf(positions[i], "%v", err)
+		}
+	}
+	fi, err := newFilterItem(allowed, operator, args)
+	if err != nil {
+		return nil, p.errorf(argsPos, "%v", err)
+	}
+	return &FilterExpression{Filter: &fi}, nil
+}
+
+func (p *filterParser) allowedField(field string) (AllowedWhere, bool) {
+	for _, v := range p.allowedWhere {
+		if v.URLField == field {
+			return v, true
+		}
+	}
+	return AllowedWhere{}, false
+}
+
+// readUnreserved reads characters up to a reserved one
+func (p *filterParser) readUnreserved() string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(reservedCharacters, rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// readOperator reads a comparison, either an alias or =<operator>=
+func (p *filterParser) readOperator() (FilterOperator, error) {
+	start := p.pos
+	for _, alias := range []string{"==", "!=", ">=", "<=", ">", "<"} {
+		if strings.HasPrefix(p.input[p.pos:], alias) {
+			p.pos += len(alias)
+			return filterOperator(expressionComparisons[alias]), nil
+		}
+	}
+
+	if p.peek() != '=' {
+		return FilterOperator{}, p.errorf(start, "expected comparison operator")
+	}
+	p.pos++
+	name := p.readUnreserved()
+	if p.peek() != '=' || name == "" {
+		return FilterOperator{}, p.errorf(start, "expected comparison operator")
+	}
+	p.pos++
+	if alias, ok := expressionComparisons["="+name+"="]; ok {
+		name = alias
+	}
+	op := filterOperator(name)
+	if op.Name == "" {
+		return FilterOperator{}, p.errorf(start, "unknown comparison operator =%s=", name)
+	}
+	return op, nil
+}
+
+// filterOperator returns the filter operator by name,
+// an empty one if not found
+func filterOperator(name string) FilterOperator {
+	for _, op := range FilterOperators {
+		if op.Name == name {
+			return op
+		}
+	}
+	return FilterOperator{}
+}
+
+// readArguments reads a value or a parenthesized list of values,
+// returning the position of each value
+func (p *filterParser) readArguments() ([]string, []int, error) {
+	if p.peek() != '(' {
+		pos := p.pos
+		v, err := p.readValue()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{v}, []int{pos}, nil
+	}
+
+	open := p.pos
+	p.pos++
+	var (
+		values    []string
+		positions []int
+	)
+	for {
+		p.skipSpaces()
+		positions = append(positions, p.pos)
+		v, err := p.readValue()
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, v)
+
+		p.skipSpaces()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return values, positions, nil
+		case 0:
+			return nil, nil, p.errorf(open, "unclosed list of values")
+		default:
+			return nil, nil, p.errorf(p.pos, "expected , or closing parenthesis")
+		}
+	}
+}
+
+// readValue reads a quoted or unreserved value.
+// Quoted values use \ to escape the next character
+func (p *filterParser) readValue() (string, error) {
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		start := p.pos
+		v := p.readUnreserved()
+		if v == "" {
+			if p.pos == len(p.input) {
+				return "", p.errorf(start, "unexpected end of filter, expected value")
+			}
+			return "", p.errorf(start, "expected value")
+		}
+		return v, nil
+	}
+
+	start := p.pos
+	p.pos++
+	v := strings.Builder{}
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return v.String(), nil
+		case c == '\\' && p.pos < len(p.input):
+			v.WriteByte(p.input[p.pos])
+			p.pos++
+		default:
+			v.WriteByte(c)
+		}
+	}
+	return "", p.errorf(start, "unclosed quoted value")
+}
+
+// ExpressionClause will return the sql where clause for a filter expression
+// - placeholders are numbered after the values already present,
+// which are returned along with the expression values
+// - nested logical expressions are enclosed in parentheses
+// - returned value doesn't include trailing spaces
+func ExpressionClause(e *FilterExpression, values []interface{}) (string, []interface{}, error) {
+	where := strings.Builder{}
+	values, err := writeExpression(&where, e, values)
+	if err != nil {
+		return "", nil, err
+	}
+	return where.String(), values, nil
+}
+
+func writeExpression(where *strings.Builder, e *FilterExpression, values []interface{}) ([]interface{}, error) {
+	if e.Filter != nil {
+		return writeFilterItem(where, *e.Filter, values)
+	}
+	if e.Logic != ExpressionAnd && e.Logic != ExpressionOr {
+		return nil, errors.Errorf("%s is not a supported filter expression logic", e.Logic)
+	}
+	if len(e.Operands) == 0 {
+		return nil, errors.Errorf("missing operands at %s filter expression", e.Logic)
+	}
+
+	var err error
+	for i, o := range e.Operands {
+		if i != 0 {
+			where.WriteString(" " + e.Logic + " ")
+		}
+		if o.Filter != nil {
+			values, err = writeFilterItem(where, *o.Filter, values)
+		} else {
+			where.WriteString("(")
+			values, err = writeExpression(where, o, values)
+			where.WriteString(")")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
@@ -9,152 +9,473 @@ import (
 )
 
 const (
-	pageQuery     = "page"
-	pageSizeQuery = "page_size"
+	// PageQuery at query string
+	PageQuery = "page"
+	// PageSizeQuery at query string
+	PageSizeQuery = "page_size"
 	// OrderByQuery at query string
 	OrderByQuery = "order"
+	// SearchQuery at query string
+	SearchQuery = "q"
+	// CursorQuery at query string
+	CursorQuery = "cursor"
+	// FieldsQuery at query string
+	FieldsQuery = "fields"
+
+	// tieBreakerField is appended to ordering so that
+	// items order is always deterministic
+	tieBreakerField = "id"
 
 	// Ordering
 	ascending  = "asc"
 	descending = "desc"
+	nullsFirst = "first"
+	nullsLast  = "last"
 )
 
+// Filter operators at query string
+const (
+	OperatorEq   = "eq"
+	OperatorNe   = "ne"
+	OperatorGt   = "gt"
+	OperatorGte  = "gte"
+	OperatorLt   = "lt"
+	OperatorLte  = "lte"
+	OperatorIn   = "in"
+	OperatorLike = "like"
+)
+
+// null check comparisons, used by presence filters
+const (
+	isNull    = "is null"
+	isNotNull = "is not null"
+)
+
+// FilterOperator maps a query string operator to its SQL comparison
+type FilterOperator struct {
+	Name        string
+	Comparison  string
+	Description string
+}
+
+// FilterOperators lists the supported filter operators,
+// filters are built in this order
+var FilterOperators = []FilterOperator{
+	{Name: OperatorEq, Comparison: "=", Description: "equal to"},
+	{Name: OperatorNe, Comparison: "<>", Description: "not equal to"},
+	{Name: OperatorGt, Comparison: ">", Description: "greater than"},
+	{Name: OperatorGte, Comparison: ">=", Description: "greater than or equal to"},
+	{Name: OperatorLt, Comparison: "<", Description: "less than"},
+	{Name: OperatorLte, Comparison: "<=", Description: "less than or equal to"},
+	{Name: OperatorIn, Comparison: "in", Description: "one of the comma separated values"},
+	{Name: OperatorLike, Comparison: "like", Description: "matching the pattern, * matches any characters"},
+}
+
+// FilterParameter returns the query string parameter for a
+// filter field and operator, equality doesn't need a suffix
+func FilterParameter(urlField, operator string) string {
+	if operator == OperatorEq {
+		return urlField
+	}
+	return fmt.Sprintf("%s[%s]", urlField, operator)
+}
+
 // PaginationClauseFromRequest uses PaginationClause using values from a map
 // as prefixed input parameters
 func PaginationClauseFromRequest(values map[string]string) (string, error) {
+	page, pageSize, err := PaginationFromRequest(values)
+	if err != nil {
+		return "", err
+	}
+	// page_size 0 means to list all
+	if pageSize == 0 {
+		return "", nil
+	}
+	return PaginationClause(page, pageSize)
+}
+
+// PaginationFromRequest returns page and page size from a values map.
+// Page defaults to 1 and page size to 50, a page size of 0 means to list all
+func PaginationFromRequest(values map[string]string) (int, int, error) {
 	page := 1
 	pageSize := 50
 	var err error
 
-	if p := values[pageQuery]; p != "" {
+	if p := values[PageQuery]; p != "" {
 		page, err = strconv.Atoi(p)
 		if err != nil {
-			return "", errors.Wrapf(err, "error parsing pagination %s", pageQuery)
+			return 0, 0, errors.Wrapf(err, "error parsing pagination %s", PageQuery)
 		}
 	}
-	if p := values[pageSizeQuery]; p != "" {
+	if p := values[PageSizeQuery]; p != "" {
 		pageSize, err = strconv.Atoi(p)
 		if err != nil {
-			return "", errors.Wrapf(err, "error parsing pagination %s", pageSizeQuery)
-		}
-		// page_size 0 means to list all
-		if pageSize == 0 {
-			return "", nil
+			return 0, 0, errors.Wrapf(err, "error parsing pagination %s", PageSizeQuery)
 		}
 	}
-	return PaginationClause(page, pageSize)
+	return page, pageSize, nil
 }
 
 // WhereClauseFromRequest given a values map builds a filter
 // looking for allowed filter fields
 func WhereClauseFromRequest(values map[string]string, allowedWhere []AllowedWhere) (string, []interface{}, error) {
-	// build the FilterItem array of items that conform
-	// the where clause
+	fis, err := FilterItemsFromRequest(values, allowedWhere)
+	if err != nil {
+		return "", nil, err
+	}
+	return WhereClause(fis)
+}
+
+// FilterItemsFromRequest given a values map builds the FilterItem
+// array of items that conform the where clause.
+// Filters are written as field=value for equality, or with an operator
+// suffix as field[operator]=value, see FilterOperators. Each field only
+// accepts the operators listed at its AllowedWhere
+func FilterItemsFromRequest(values map[string]string, allowedWhere []AllowedWhere) ([]FilterItem, error) {
+	if err := checkFilterOperators(values, allowedWhere); err != nil {
+		return nil, err
+	}
+
 	var fis []FilterItem
 	for _, v := range allowedWhere {
-		if value := values[v.URLField]; value != "" {
-			if v.Type != "" {
-				// There must be a better way of doing this
-				var err error
-				switch v.Type {
-				case "integer":
-					_, err = strconv.Atoi(value)
-				case "boolean":
-					_, err = strconv.ParseBool(value)
-				}
-				if err != nil {
-					return "", nil, errors.Wrapf(err, "field %s value %s can't be converted to %s",
-						v.URLField, value, v.Type)
-				}
+		for _, op := range FilterOperators {
+			value := values[FilterParameter(v.URLField, op.Name)]
+			if value == "" || !v.Allows(op.Name) {
+				continue
+			}
+
+			rawValues := []string{value}
+			if op.Name == OperatorIn {
+				rawValues = strings.Split(value, ",")
 			}
-			fi := FilterItem{
-				Field: v.DBField,
-				Value: value,
-				// TODO add comparisons, for now assume equal
-				Comparison: "=",
+			fi, err := newFilterItem(v, op, rawValues)
+			if err != nil {
+				return nil, err
 			}
 			fis = append(fis, fi)
 		}
 	}
 
-	return WhereClause(fis)
+	return fis, nil
+}
+
+// newFilterItem builds the filter item comparing a field to values
+// using an operator. Only in comparisons take more than one value
+func newFilterItem(v AllowedWhere, op FilterOperator, rawValues []string) (FilterItem, error) {
+	typedValues := make([]interface{}, len(rawValues))
+	for i, rv := range rawValues {
+		tv, err := filterValue(v, rv)
+		if err != nil {
+			return FilterItem{}, err
+		}
+		typedValues[i] = tv
+	}
+
+	fi := FilterItem{
+		Field:      v.DBField,
+		Value:      typedValues[0],
+		Comparison: op.Comparison,
+	}
+	if op.Name == OperatorEq && v.Comparison != "" {
+		fi.Comparison = v.Comparison
+	}
+	switch {
+	case v.Type == "presence":
+		fi.Comparison = isNull
+		if typedValues[0].(bool) {
+			fi.Comparison = isNotNull
+		}
+		fi.Value = nil
+	case op.Name == OperatorIn:
+		fi.Value = typedValues
+	case op.Name == OperatorLike:
+		fi.Value = likePattern(rawValues[0])
+	}
+	return fi, nil
+}
+
+// checkFilterOperators rejects operators not allowed for a filter field
+func checkFilterOperators(values map[string]string, allowedWhere []AllowedWhere) error {
+	for key := range values {
+		open := strings.Index(key, "[")
+		if open == -1 || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		field, operator := key[:open], key[open+1:len(key)-1]
+		for _, v := range allowedWhere {
+			if v.URLField == field && !v.Allows(operator) {
+				return errors.Errorf("operator %s is not allowed for field %s", operator, field)
+			}
+		}
+	}
+	return nil
+}
+
+// filterValue checks that a filter value can be converted to the field type.
+// Timestamps and presence checks are returned converted, the original
+// value is kept for other types
+func filterValue(v AllowedWhere, value string) (interface{}, error) {
+	// There must be a better way of doing this
+	var (
+		converted interface{} = value
+		err       error
+	)
+	switch v.Type {
+	case "integer":
+		_, err = strconv.Atoi(value)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	case "presence":
+		converted, err = strconv.ParseBool(value)
+	case "timestamp":
+		converted, err = ParseTimestamp(value, now())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "field %s value %s can't be converted to %s",
+			v.URLField, value, v.Type)
+	}
+	return converted, nil
+}
+
+// LikeEscaper escapes like expression wildcards, using \ as escape character
+var LikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern turns a filter value using * as wildcard into
+// a like pattern using \ as escape character
+func likePattern(value string) string {
+	return strings.Replace(LikeEscaper.Replace(value), "*", "%", -1)
+}
+
+// FieldsFromRequest given a values map returns the fields requested
+// for projection as a comma separated list, ?fields=id,name
+// No fields are returned if not requested, meaning all of them
+func FieldsFromRequest(values map[string]string, allowedFields []AllowedField) ([]AllowedField, error) {
+	urlFields := values[FieldsQuery]
+	if urlFields == "" {
+		return nil, nil
+	}
+
+	var fields []AllowedField
+	for _, f := range strings.Split(urlFields, ",") {
+		f = strings.TrimSpace(f)
+		isAllowed := false
+		for _, allowed := range allowedFields {
+			if f == allowed.URLField {
+				isAllowed = true
+				if !containsField(fields, f) {
+					fields = append(fields, allowed)
+				}
+				break
+			}
+		}
+		if !isAllowed {
+			return nil, errors.Errorf("field %s is not allowed for projection", f)
+		}
+	}
+	return fields, nil
+}
+
+// containsField checks if a field is already at a fields list
+func containsField(fields []AllowedField, urlField string) bool {
+	for _, f := range fields {
+		if f.URLField == urlField {
+			return true
+		}
+	}
+	return false
 }
 
-// OrderByClauseFromRequest given a values map builds an order by clause
+// OrderItemsFromRequest given a values map builds the OrderItem
+// array of items that conform the order by clause
 // Order can be specified at requests as:
 // - ?order=field1
 // - ?order=field1:asc
 // - ?order=field1,field2:desc
-func OrderByClauseFromRequest(values map[string]string, allowedOrderBy []string) (string, error) {
+// - ?order=field1:asc:nullsfirst,field2:nullslast
+// Nullable fields without null ordering place nulls as
+// greater than any value, last when ascending and first when descending
+func OrderItemsFromRequest(values map[string]string, allowedOrderBy []AllowedOrder) ([]OrderItem, error) {
 
 	urlOrder := values[OrderByQuery]
 	if urlOrder == "" {
-		return "", nil
+		return nil, nil
 	}
 
 	uo := strings.Split(urlOrder, ",")
-	orderby := ""
+	var ois []OrderItem
 	for _, value := range uo {
 		v := strings.Split(value, ":")
-		if len(v) > 1 &&
-			v[1] != ascending &&
-			v[1] != descending {
-			return "", errors.Errorf("ordering clause %s has wrong modifier %s",
-				v[0], v[1])
+		allowed, ok := allowedOrder(allowedOrderBy, v[0])
+		if !ok {
+			return nil, errors.Errorf("field %s is not allowed for sorting", v[0])
 		}
-		isAllowed := false
-		for _, allowed := range allowedOrderBy {
-			if v[0] == allowed {
-				if len(orderby) == 0 {
-					orderby = fmt.Sprintf("%s", v[0])
-				} else {
-					orderby = fmt.Sprintf("%s,%s", orderby, v[0])
-				}
-				if len(v) > 1 {
-					orderby = fmt.Sprintf("%s %s", orderby, v[1])
-				}
-				isAllowed = true
-				break
+		oi := OrderItem{Field: allowed.DBField, Type: allowed.Type}
+		for _, modifier := range v[1:] {
+			switch {
+			case (modifier == ascending || modifier == descending) && oi.Sort == "" && oi.Nulls == "":
+				oi.Sort = modifier
+			case (modifier == "nulls"+nullsFirst || modifier == "nulls"+nullsLast) && oi.Nulls == "":
+				oi.Nulls = strings.TrimPrefix(modifier, "nulls")
+			default:
+				return nil, errors.Errorf("ordering clause %s has wrong modifier %s",
+					v[0], modifier)
 			}
 		}
-		if !isAllowed {
-			return "", errors.Errorf("field %s is not allowed for sorting", v[0])
+		if allowed.Nullable && oi.Nulls == "" {
+			if oi.NullsFirst() {
+				oi.Nulls = nullsFirst
+			} else {
+				oi.Nulls = nullsLast
+			}
 		}
+		ois = append(ois, oi)
 	}
 
-	return orderby, nil
+	return ois, nil
+}
+
+// allowedOrder returns the allowed order field by its URL name
+func allowedOrder(allowedOrderBy []AllowedOrder, urlField string) (AllowedOrder, bool) {
+	for _, allowed := range allowedOrderBy {
+		if allowed.URLField == urlField {
+			return allowed, true
+		}
+	}
+	return AllowedOrder{}, false
+}
+
+// WhereQueryFromRequest given a values map builds a query holding
+// only the filters, filter expression and search terms of a request,
+// with no ordering nor pagination
+func WhereQueryFromRequest(values map[string]string, allowedWhere []AllowedWhere) (*Query, error) {
+	filters, err := FilterItemsFromRequest(values, allowedWhere)
+	if err != nil {
+		wrap := errors.Wrap(err, "error parsing query filters")
+		return nil, wrap
+	}
+	where, whereParams, err := WhereClause(filters)
+	if err != nil {
+		wrap := errors.Wrap(err, "error parsing query filters")
+		return nil, wrap
+	}
+
+	var expression *FilterExpression
+	if f := strings.TrimSpace(values[FilterQuery]); f != "" {
+		expression, err = ParseFilterExpression(f, allowedWhere)
+		if err != nil {
+			wrap := errors.Wrap(err, "error parsing query filter expression")
+			return nil, wrap
+		}
+		var clause string
+		clause, whereParams, err = ExpressionClause(expression, whereParams)
+		if err != nil {
+			wrap := errors.Wrap(err, "error parsing query filter expression")
+			return nil, wrap
+		}
+		// or expressions are grouped so that conditions appended
+		// to the where clause apply to all of them
+		if len(where) != 0 || expression.Logic == ExpressionOr {
+			clause = fmt.Sprintf("(%s)", clause)
+		}
+		if len(where) != 0 {
+			where = fmt.Sprintf("%s and %s", where, clause)
+		} else {
+			where = clause
+		}
+	}
+
+	q := &Query{
+		Where:       where,
+		WhereParams: whereParams,
+		Search:      strings.TrimSpace(values[SearchQuery]),
+		Filters:     filters,
+		Expression:  expression,
+	}
+	return q, nil
 }
 
 // BuildQueryClauseFromRequest for objects
 func BuildQueryClauseFromRequest(
 	values map[string]string,
 	allowedWhere []AllowedWhere,
-	allowedOrderBy []string) (*Query, error) {
+	allowedOrderBy []AllowedOrder) (*Query, error) {
 
-	where, whereParams, err := WhereClauseFromRequest(values, allowedWhere)
+	q, err := WhereQueryFromRequest(values, allowedWhere)
 	if err != nil {
-		wrap := errors.Wrap(err, "error parsing query filters")
-		return nil, wrap
+		return nil, err
 	}
+	where, whereParams, search := q.Where, q.WhereParams, q.Search
 
-	pag, err := PaginationClauseFromRequest(values)
+	orderBy, err := OrderItemsFromRequest(values, allowedOrderBy)
 	if err != nil {
-		wrap := errors.Wrap(err, "error parsing pagination")
+		wrap := errors.Wrap(err, "error parsing query order")
 		return nil, wrap
 	}
+	// searches without explicit order are sorted by relevance
+	if len(orderBy) != 0 || search == "" {
+		orderBy = withTieBreaker(orderBy)
+	}
 
-	order, err := OrderByClauseFromRequest(values, allowedOrderBy)
+	page, pageSize, err := PaginationFromRequest(values)
 	if err != nil {
-		wrap := errors.Wrap(err, "error parsing query order")
+		wrap := errors.Wrap(err, "error parsing pagination")
 		return nil, wrap
 	}
 
-	q := &Query{
-		Where:         where,
-		WhereParams:   whereParams,
-		Pagination:    pag,
-		OrderByClause: order,
+	var cursor *Cursor
+	if c := values[CursorQuery]; c != "" {
+		if values[PageQuery] != "" {
+			return nil, errors.New("cursor and page can't be used together")
+		}
+		if len(orderBy) == 0 {
+			return nil, errors.New("cursor can't be used for searches sorted by relevance")
+		}
+		cursor, err = DecodeCursor(c, orderBy)
+		if err != nil {
+			wrap := errors.Wrap(err, "error parsing cursor")
+			return nil, wrap
+		}
+		keyset, keysetParams, err := KeysetClause(orderBy, cursor.Values, len(whereParams)+1)
+		if err != nil {
+			wrap := errors.Wrap(err, "error parsing cursor")
+			return nil, wrap
+		}
+		if len(where) != 0 {
+			where = fmt.Sprintf("%s and %s", where, keyset)
+		} else {
+			where = keyset
+		}
+		whereParams = append(whereParams, keysetParams...)
+	}
+
+	pag := ""
+	if pageSize != 0 {
+		pag, err = PaginationClause(page, pageSize)
+		if err != nil {
+			wrap := errors.Wrap(err, "error parsing pagination")
+			return nil, wrap
+		}
 	}
 
+	q.Where = where
+	q.WhereParams = whereParams
+	q.Pagination = pag
+	q.OrderByClause = OrderByClause(orderBy)
+	q.Page = page
+	q.PageSize = pageSize
+	q.OrderBy = orderBy
+	q.Cursor = cursor
+
 	return q, nil
 }
+
+// withTieBreaker appends the tie breaker field to the order items
+// if not already present
+func withTieBreaker(items []OrderItem) []OrderItem {
+	for _, o := range items {
+		if o.Field == tieBreakerField {
+			return items
+		}
+	}
+	return append(items, OrderItem{Field: tieBreakerField, Type: "integer"})
+}
@@ -2,17 +2,36 @@ package clauses
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // Query is a placeholder for SQL clauses
+// Filters, Expression, Page, PageSize and OrderBy keep the parsed items
+// the SQL clauses were built from, for non SQL backends.
+// Expression must match along with all Filters when present.
+// Fields limits the retrieved DB fields, all of them are retrieved if empty.
+// Search contains free text search terms, which each backend
+// combines with the where clause.
+// When Cursor is set the where clause includes the keyset condition
+// for the cursor, and pagination is limited to the page size
 type Query struct {
 	Where         string
 	WhereParams   []interface{}
 	Pagination    string
 	OrderByClause string
+	Search        string
+
+	Fields     []string
+	Filters    []FilterItem
+	Expression *FilterExpression
+	Page       int
+	PageSize   int
+	OrderBy    []OrderItem
+	Cursor     *Cursor
 }
 
 // FilterItem is a placeholder for SQL where clause items
@@ -23,19 +42,73 @@ type FilterItem struct {
 }
 
 // AllowedWhere keeps the allowed fields to build queries
-// Type will be checked at validation
-// TODO this info might be extracted using reflection from
-// the model type, or be generated
+// Type will be checked at validation, one of:
+// - string, integer or boolean
+// - timestamp, RFC3339 times, dates or times relative to now, see ParseTimestamp
+// - presence, a boolean checking if the field is not null
+// Operators lists the filter operators allowed for the field,
+// only equality is allowed if empty.
+// Comparison replaces equality for the field without operator
+// suffix, as in due_before=now
+// They can be derived from the model type, see AllowlistsFromType
 type AllowedWhere struct {
+	URLField   string
+	DBField    string
+	Type       string
+	Operators  []string
+	Comparison string
+}
+
+// Allows checks if a filter operator can be used for the field
+func (a AllowedWhere) Allows(operator string) bool {
+	if len(a.Operators) == 0 {
+		return operator == OperatorEq
+	}
+	for _, o := range a.Operators {
+		if o == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedField keeps the fields that can be requested for projection
+// and their mapping to DB fields
+type AllowedField struct {
+	URLField string
+	DBField  string
+}
+
+// AllowedOrder keeps the fields that listings can be sorted by
+// and their mapping to DB fields.
+// Type is one of AllowedWhere types, used to convert cursor values.
+// Nullable fields are always sorted placing nulls explicitly,
+// so that all backends return them at the same position
+// They can be derived from the model type, see AllowlistsFromType
+type AllowedOrder struct {
 	URLField string
 	DBField  string
 	Type     string
+	Nullable bool
 }
 
 // OrderItem is a placeholder for SQL orderby clause items
+// Sort is either asc or desc, ascending if empty.
+// Nulls is either first or last, when empty nulls are not
+// expected and are sorted as greater than any value
 type OrderItem struct {
 	Field string
 	Sort  string
+	Nulls string
+	Type  string
+}
+
+// NullsFirst checks if null values are sorted before the rest
+func (o OrderItem) NullsFirst() bool {
+	if o.Nulls != "" {
+		return o.Nulls == nullsFirst
+	}
+	return o.Sort == descending
 }
 
 // PaginationClause will return the pagination sql clause
@@ -55,33 +128,168 @@ func PaginationClause(page, pageSize int) (string, error) {
 }
 
 // WhereClause will return sql where items clause
+// - null checks don't use a value
+// - in comparisons expect a non empty list of values
+// - like comparisons use \ as escape character
 // - returned value doesn't include trailing spaces
 func WhereClause(filters []FilterItem) (string, []interface{}, error) {
-
-	l := len(filters)
 	where := strings.Builder{}
 	values := []interface{}{}
+	var err error
 	for i, f := range filters {
-		if len(f.Field) == 0 {
-			return "", nil, errors.New("missing 'field' at the filter clause")
-		}
-		if f.Comparison != ">" &&
-			f.Comparison != "<" &&
-			f.Comparison != "=" {
-			return "", nil,
-				fmt.Errorf("%s is not one of the supported compare clauses", f.Comparison)
+		if i != 0 {
+			where.WriteString(" and ")
 		}
-		if f.Value == nil {
-			return "", nil, errors.New("missing 'value' at the filter clause")
+		values, err = writeFilterItem(&where, f, values)
+		if err != nil {
+			return "", nil, err
 		}
+	}
+	return where.String(), values, nil
+}
 
-		where.WriteString(fmt.Sprintf("%s %s $%d", f.Field, f.Comparison, i+1))
-		if i != l-1 {
-			where.WriteString(" and ")
+// writeFilterItem writes a filter item comparison, appending its
+// values to those already present, which number the placeholders
+func writeFilterItem(where *strings.Builder, f FilterItem, values []interface{}) ([]interface{}, error) {
+	if len(f.Field) == 0 {
+		return nil, errors.New("missing 'field' at the filter clause")
+	}
+	if !supportedComparison(f.Comparison) {
+		return nil, fmt.Errorf("%s is not one of the supported compare clauses", f.Comparison)
+	}
+	if f.Comparison == isNull || f.Comparison == isNotNull {
+		where.WriteString(fmt.Sprintf("%s %s", f.Field, f.Comparison))
+		return values, nil
+	}
+	if f.Value == nil {
+		return nil, errors.New("missing 'value' at the filter clause")
+	}
+
+	switch f.Comparison {
+	case "in":
+		list, ok := f.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, errors.Errorf("filter on %s needs a list of values", f.Field)
+		}
+		placeholders := make([]string, len(list))
+		for j, v := range list {
+			values = append(values, v)
+			placeholders[j] = fmt.Sprintf("$%d", len(values))
 		}
+		where.WriteString(fmt.Sprintf("%s in (%s)", f.Field, strings.Join(placeholders, ", ")))
+	case "like":
+		values = append(values, f.Value)
+		where.WriteString(fmt.Sprintf(`%s like $%d escape '\'`, f.Field, len(values)))
+	default:
 		values = append(values, f.Value)
+		where.WriteString(fmt.Sprintf("%s %s $%d", f.Field, f.Comparison, len(values)))
 	}
-	return where.String(), values, nil
+	return values, nil
+}
+
+// supportedComparison checks if a filter comparison is one of
+// FilterOperators or a null check
+func supportedComparison(comparison string) bool {
+	if comparison == isNull || comparison == isNotNull {
+		return true
+	}
+	for _, op := range FilterOperators {
+		if op.Comparison == comparison {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderByClause will return the sql order by items clause
+// - returned value doesn't include trailing spaces
+func OrderByClause(items []OrderItem) string {
+	orderby := strings.Builder{}
+	for i, o := range items {
+		if i != 0 {
+			orderby.WriteString(",")
+		}
+		orderby.WriteString(o.Field)
+		if o.Sort != "" {
+			orderby.WriteString(" " + o.Sort)
+		}
+		if o.Nulls != "" {
+			orderby.WriteString(" nulls " + o.Nulls)
+		}
+	}
+	return orderby.String()
+}
+
+// KeysetClause will return the sql where clause selecting items
+// after the cursor values for the order items
+// - placeholders are numbered starting at start
+// - nil values are null, which are only expected for items with Nulls set
+// - values are converted to the order item Type
+// - returned value doesn't include trailing spaces
+func KeysetClause(items []OrderItem, values []*string, start int) (string, []interface{}, error) {
+	if len(items) == 0 || len(items) != len(values) {
+		return "", nil, errors.Errorf("keyset has %d values for %d order fields",
+			len(values), len(items))
+	}
+
+	// equal keeps the conditions for items equal to the cursor
+	// up to the current order item
+	equal := strings.Builder{}
+	terms := []string{}
+	params := []interface{}{}
+	for i, o := range items {
+		if values[i] == nil {
+			if o.Nulls == "" {
+				return "", nil, errors.Errorf("keyset field %s can't be null", o.Field)
+			}
+			// only non null values follow nulls
+			if o.NullsFirst() {
+				terms = append(terms, fmt.Sprintf("(%s%s is not null)", equal.String(), o.Field))
+			}
+			equal.WriteString(fmt.Sprintf("%s is null and ", o.Field))
+			continue
+		}
+
+		v, err := keysetValue(o, *values[i])
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, v)
+		n := start + len(params) - 1
+
+		comparison := ">"
+		if o.Sort == descending {
+			comparison = "<"
+		}
+		if o.Nulls != "" && !o.NullsFirst() {
+			terms = append(terms, fmt.Sprintf("(%s(%s %s $%d or %s is null))",
+				equal.String(), o.Field, comparison, n, o.Field))
+		} else {
+			terms = append(terms, fmt.Sprintf("(%s%s %s $%d)", equal.String(), o.Field, comparison, n))
+		}
+		equal.WriteString(fmt.Sprintf("%s = $%d and ", o.Field, n))
+	}
+	if len(terms) == 0 {
+		return "", nil, errors.New("keyset has no items after the cursor")
+	}
+	return "(" + strings.Join(terms, " or ") + ")", params, nil
 }
 
-// TODO create order by generic (currently only OrderByClause at the URL helper)
+// keysetValue converts a cursor value to the order item type
+func keysetValue(o OrderItem, value string) (interface{}, error) {
+	switch o.Type {
+	case "integer":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "keyset field %s is not an integer", o.Field)
+		}
+		return v, nil
+	case "timestamp":
+		v, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "keyset field %s is not a timestamp", o.Field)
+		}
+		return v, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,54 @@
+package clauses
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// now returns the time relative timestamps are parsed from
+var now = time.Now
+
+// relativeTimestamp matches times relative to now such as now, now-7d or now+2h
+var relativeTimestamp = regexp.MustCompile(`^now(?:([+-])(\d+)([smhdw]))?$`)
+
+// relativeUnits are the durations of relative timestamp units
+var relativeUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// ParseTimestamp parses a filter timestamp, returned in UTC. Accepted values are
+// - RFC3339 times: 2019-05-01T10:00:00Z
+// - dates, at midnight UTC: 2019-05-01
+// - times relative to now, using s, m, h, d or w units: now, now-7d, now+12h
+func ParseTimestamp(value string, now time.Time) (time.Time, error) {
+	if m := relativeTimestamp.FindStringSubmatch(value); m != nil {
+		if m[1] == "" {
+			return now.UTC(), nil
+		}
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "error parsing relative time %s", value)
+		}
+		d := time.Duration(n) * relativeUnits[m[3]]
+		if m[1] == "-" {
+			d = -d
+		}
+		return now.Add(d).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("%s is not a RFC3339 time, date or relative time such as now-7d", value)
+	}
+	return t, nil
+}
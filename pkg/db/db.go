@@ -1,47 +1,119 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"regexp"
+	"time"
 
 	// postgres db
 	_ "github.com/lib/pq"
+	// sqlite db
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
 	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
 )
 
-const postgresDriver = "postgres"
+// Supported database drivers
+const (
+	PostgresDriver = "postgres"
+	SQLiteDriver   = "sqlite3"
+)
+
+// postgresPlaceholder matches $1 style query parameters
+var postgresPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// TaskStore exposes Task persistence methods.
+// Operations only access tasks of the tenant at the context,
+// and are aborted when the context is done.
+// Tasks can be retrieved limited to some fields, their ID
+// and version are always retrieved
+type TaskStore interface {
+	SelectTasks(ctx context.Context, q *clauses.Query) ([]types.Task, error)
+	CountTasks(ctx context.Context, q *clauses.Query) (int, error)
+	TaskStats(ctx context.Context, q *clauses.Query, groupBy []string) ([]types.TaskCount, error)
+	GetTask(ctx context.Context, ID int, fields ...string) (*types.Task, error)
+	CreateTask(ctx context.Context, item *types.Task) (*types.Task, error)
+	ImportTasks(ctx context.Context, items []*types.Task) error
+	UpdateOneTask(ctx context.Context, item *types.Task) (*types.Task, error)
+	DeleteOneTask(ctx context.Context, ID, version int) error
+	RestoreTask(ctx context.Context, ID, version int) (*types.Task, error)
+	TaskHistory(ctx context.Context, ID int, q *clauses.Query) ([]types.TaskRevision, error)
+}
+
+// ErrVersionConflict is returned when a task was modified
+// by someone else since it was read
+var ErrVersionConflict = errors.New("task was modified by someone else")
+
+// ErrNotDeleted is returned when restoring a task that is not deleted
+var ErrNotDeleted = errors.New("task is not deleted")
+
+// ErrMissingTenant is returned when an operation context carries no tenant
+var ErrMissingTenant = errors.New("missing tenant for Task operation")
+
+// contextTenant returns the tenant an operation is executed for
+func contextTenant(ctx context.Context) (string, error) {
+	tenantID, ok := tenant.FromContext(ctx)
+	if !ok {
+		return "", ErrMissingTenant
+	}
+	return tenantID, nil
+}
 
 // PersistenceManager exposes entities persistence methods
-// for TODO list
+// for TODO list on a SQL database.
+// Queries are written for Postgres and adapted to the driver in use
 type PersistenceManager struct {
-	db *sql.DB
+	db           *sql.DB
+	replica      *sql.DB
+	driver       string
+	dispatcher   *eventDispatcher
+	queryTimeout time.Duration
 }
 
+var _ TaskStore = &PersistenceManager{}
+
 // Manager is the global reference for persistence methods
 // and should be initialized at app start
-var Manager *PersistenceManager
+var Manager TaskStore
+
+// PoolOptions configures a database connection pool
+type PoolOptions struct {
+	// MaxOpenConns limits the open connections, 0 means no limit
+	MaxOpenConns int
+	// MaxIdleConns limits the connections kept idle for reuse
+	MaxIdleConns int
+	// ConnMaxLifetime limits the time a connection is reused, 0 means no limit
+	ConnMaxLifetime time.Duration
+}
+
+// connection retry backoff, doubled after each failed attempt
+var (
+	connectInitialBackoff = 500 * time.Millisecond
+	connectMaxBackoff     = 10 * time.Second
+)
 
 // ConnectPostgressDB returns a connected db object
-func ConnectPostgressDB(host string, port int, user, pass, database string, dbSSL bool) (*sql.DB, error) {
-	dataSource := fmt.Sprintf("host=%s port=%d user=%s dbname=%s",
-		host, port, user, database)
-	if dbSSL {
-		dataSource += " sslmode=require"
-	} else {
-		dataSource += " sslmode=disable"
-	}
+func ConnectPostgressDB(host string, port int, user, pass, database string, dbSSL bool, pool PoolOptions) (*sql.DB, error) {
+	dataSource := postgresDataSource(host, port, user, database, dbSSL)
 	log.V(5).Info("connecting to database",
 		"datasource (password not shown)", dataSource)
 
 	dataSource += fmt.Sprintf(" password=%s", pass)
 
-	db, err := sql.Open(postgresDriver, dataSource)
+	db, err := sql.Open(PostgresDriver, dataSource)
 	if err != nil {
 		return nil, errors.Wrapf(err, "user %s couldn't open database %s:%d/%s",
 			user, host, port, database)
 	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
 	log.V(5).Info("pinging database", "database", database)
 	if err = db.Ping(); err != nil {
@@ -52,7 +124,180 @@ func ConnectPostgressDB(host string, port int, user, pass, database string, dbSS
 	return db, nil
 }
 
+// ConnectPostgresReplicaDB returns a connected db object for a read
+// only replica given its Postgres connection string
+func ConnectPostgresReplicaDB(dataSource string, pool PoolOptions) (*sql.DB, error) {
+	log.V(5).Info("connecting to database replica")
+
+	db, err := sql.Open(PostgresDriver, dataSource)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open database replica")
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	log.V(5).Info("pinging database replica")
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "error pinging database replica")
+	}
+	return db, nil
+}
+
+// ConnectWithRetry calls connect until it succeeds or the context is done,
+// waiting with exponential backoff between attempts.
+// The last connection error is returned if no attempt succeeds
+func ConnectWithRetry(ctx context.Context, connect func() (*sql.DB, error)) (*sql.DB, error) {
+	backoff := connectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		log.V(5).Info("connecting to database", "attempt", attempt)
+		db, err := connect()
+		if err == nil {
+			return db, nil
+		}
+
+		log.Error(err, "database connection attempt failed",
+			"attempt", attempt,
+			"retry in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(err, "giving up connecting to database after %d attempts", attempt)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+// postgresDataSource returns a Postgres connection string without password
+func postgresDataSource(host string, port int, user, database string, dbSSL bool) string {
+	dataSource := fmt.Sprintf("host=%s port=%d user=%s dbname=%s",
+		host, port, user, database)
+	if dbSSL {
+		dataSource += " sslmode=require"
+	} else {
+		dataSource += " sslmode=disable"
+	}
+	return dataSource
+}
+
+// ConnectSQLiteDB returns a connected db object for a SQLite
+// database file, which is created if it doesn't exist
+func ConnectSQLiteDB(path string) (*sql.DB, error) {
+	log.V(5).Info("connecting to database", "path", path)
+
+	db, err := sql.Open(SQLiteDriver, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open database %s", path)
+	}
+	// SQLite doesn't support concurrent writers
+	db.SetMaxOpenConns(1)
+
+	log.V(5).Info("pinging database", "path", path)
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "error pinging database %s", path)
+	}
+	return db, nil
+}
+
 // NewTODOPersistenceManager returns a persistence manager for TODO
+// on a Postgres database
 func NewTODOPersistenceManager(db *sql.DB) *PersistenceManager {
-	return &PersistenceManager{db: db}
+	p := &PersistenceManager{db: db, driver: PostgresDriver}
+	p.dispatcher = newEventDispatcher(p)
+	return p
+}
+
+// NewSQLitePersistenceManager returns a persistence manager for TODO
+// on a SQLite database
+func NewSQLitePersistenceManager(db *sql.DB) *PersistenceManager {
+	p := &PersistenceManager{db: db, driver: SQLiteDriver}
+	p.dispatcher = newEventDispatcher(p)
+	return p
+}
+
+// SetQueryTimeout limits the duration of each persistence operation,
+// 0 means no limit other than the caller context
+func (p *PersistenceManager) SetQueryTimeout(timeout time.Duration) {
+	p.queryTimeout = timeout
+}
+
+// SetReplica routes task reads to a read only replica of the database.
+// Reads from contexts returned by WithPrimary, and reads done as part
+// of a write, still use the primary database
+func (p *PersistenceManager) SetReplica(replica *sql.DB) {
+	p.replica = replica
+}
+
+// primaryKey marks contexts whose reads must use the primary database
+type primaryKey struct{}
+
+// WithPrimary returns a context whose reads use the primary database,
+// so that they see the writes already made by the caller
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// reader returns the database reads for a context are sent to
+func (p *PersistenceManager) reader(ctx context.Context) *sql.DB {
+	if p.replica == nil {
+		return p.db
+	}
+	if primary, _ := ctx.Value(primaryKey{}).(bool); primary {
+		return p.db
+	}
+	return p.replica
+}
+
+// withTimeout returns a context limited by the query timeout
+func (p *PersistenceManager) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.queryTimeout)
+}
+
+// wrapError annotates a database error. When the context is done its error
+// is reported instead, since drivers return their own cancellation errors
+func wrapError(ctx context.Context, err error, message string) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrap(ctxErr, message)
+	}
+	return errors.Wrap(err, message)
+}
+
+// executor is satisfied by both *sql.DB and *sql.Tx
+type executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// prepare creates a prepared statement adapting the query
+// placeholders to the driver in use
+func (p *PersistenceManager) prepare(ctx context.Context, ex executor, query string) (*sql.Stmt, error) {
+	return ex.PrepareContext(ctx, p.rebind(query))
+}
+
+// paginationClause returns the query pagination adapted to the driver in use
+func (p *PersistenceManager) paginationClause(q *clauses.Query) string {
+	if len(q.Pagination) == 0 || p.driver != SQLiteDriver {
+		return q.Pagination
+	}
+	// SQLite only supports limit before offset
+	return fmt.Sprintf("limit %d offset %d", q.PageSize, (q.Page-1)*q.PageSize)
+}
+
+// rebind turns $1 style placeholders into ?1 for SQLite
+func (p *PersistenceManager) rebind(query string) string {
+	if p.driver != SQLiteDriver {
+		return query
+	}
+	return postgresPlaceholder.ReplaceAllString(query, "?$1")
 }
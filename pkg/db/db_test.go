@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestConnectWithRetry(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		connectInitialBackoff, connectMaxBackoff = initial, max
+	}(connectInitialBackoff, connectMaxBackoff)
+	connectInitialBackoff, connectMaxBackoff = time.Millisecond, 4*time.Millisecond
+
+	var testData = []struct {
+		testName         string
+		failures         int
+		timeout          time.Duration
+		expectedAttempts int
+		expectedError    bool
+	}{
+		{
+			testName:         "first attempt succeeds",
+			failures:         0,
+			timeout:          time.Second,
+			expectedAttempts: 1,
+		},
+		{
+			testName:         "succeeds after failures",
+			failures:         5,
+			timeout:          time.Second,
+			expectedAttempts: 6,
+		},
+		{
+			testName:         "no retries without timeout",
+			failures:         5,
+			timeout:          0,
+			expectedAttempts: 1,
+			expectedError:    true,
+		},
+	}
+
+	for _, td := range testData {
+		attempts := 0
+		ctx, cancel := context.WithTimeout(context.Background(), td.timeout)
+		connDB, err := ConnectWithRetry(ctx, func() (*sql.DB, error) {
+			attempts++
+			if attempts <= td.failures {
+				return nil, errors.New("connection refused")
+			}
+			return &sql.DB{}, nil
+		})
+		cancel()
+
+		if td.expectedError != (err != nil) {
+			t.Errorf("%q: got error %v, wanted error %t", td.testName, err, td.expectedError)
+		}
+		if !td.expectedError && connDB == nil {
+			t.Errorf("%q: missing connection", td.testName)
+		}
+		if attempts != td.expectedAttempts {
+			t.Errorf("%q: got %d attempts, wanted %d", td.testName, attempts, td.expectedAttempts)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/log"
+)
+
+// Migration is a versioned database schema change.
+// Up and Down scripts are indexed by database driver
+type Migration struct {
+	Version     int
+	Description string
+	Up          map[string]string
+	Down        map[string]string
+}
+
+// MigrationStatus informs if a migration has been applied to the database
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     *time.Time
+}
+
+// SchemaVersion returns the latest migration version known to this binary
+func SchemaVersion() int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+// sortedMigrations returns known migrations sorted by version
+func sortedMigrations() []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// ensureMigrationsTable creates the table that tracks applied migrations
+func (p *PersistenceManager) ensureMigrationsTable() error {
+	query := `
+		create table if not exists schema_migrations(
+			version integer primary key,
+			description varchar(200) not null,
+			applied timestamp not null default current_timestamp
+		)`
+	log.V(10).Info("Executing query", "query", query)
+
+	if _, err := p.db.Exec(query); err != nil {
+		return errors.Wrap(err, "error creating schema_migrations table")
+	}
+	return nil
+}
+
+// appliedMigrations returns applied migrations timestamps indexed by version
+func (p *PersistenceManager) appliedMigrations() (map[int]time.Time, error) {
+	if err := p.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	query := `
+		select
+			version,
+			applied
+		from schema_migrations`
+	log.V(10).Info("Executing query", "query", query)
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving applied migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			when    time.Time
+		)
+		if err = rows.Scan(&version, &when); err != nil {
+			return nil, errors.Wrap(err, "error scanning applied migrations")
+		}
+		applied[version] = when
+	}
+	return applied, rows.Err()
+}
+
+// CurrentSchemaVersion returns the latest migration applied to the database
+func (p *PersistenceManager) CurrentSchemaVersion() (int, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for v := range applied {
+		if v > current {
+			current = v
+		}
+	}
+	return current, nil
+}
+
+// MigrationsStatus returns all known migrations and whether they were applied
+func (p *PersistenceManager) MigrationsStatus() ([]MigrationStatus, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range sortedMigrations() {
+		ms := MigrationStatus{Version: m.Version, Description: m.Description}
+		if when, ok := applied[m.Version]; ok {
+			ms.Applied = &when
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+// MigrateUp applies all pending migrations, returning those applied
+func (p *PersistenceManager) MigrateUp() ([]Migration, error) {
+	applied, err := p.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, m := range sortedMigrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Info("applying migration", "version", m.Version, "description", m.Description)
+		ok, err := p.runMigration(m, true)
+		if err != nil {
+			return done, err
+		}
+		if ok {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the latest applied migration, returning it.
+// If no migration is applied nil is returned
+func (p *PersistenceManager) MigrateDown() (*Migration, error) {
+	current, err := p.CurrentSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return nil, nil
+	}
+
+	for _, m := range migrations {
+		if m.Version != current {
+			continue
+		}
+		log.Info("reverting migration", "version", m.Version, "description", m.Description)
+		if _, err = p.runMigration(m, false); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	return nil, errors.Errorf("database schema version %d is unknown to this binary", current)
+}
+
+// runMigration executes a migration script and records it in a
+// single transaction. If another process already ran the migration
+// it is skipped and false is returned
+func (p *PersistenceManager) runMigration(m Migration, up bool) (bool, error) {
+	script, record := m.Up[p.driver], `
+		insert into schema_migrations
+			(version, description)
+		values
+			($1, $2)`
+	if !up {
+		script, record = m.Down[p.driver], `
+		delete from schema_migrations
+		where
+			version = $1 and description = $2`
+	}
+	if script == "" {
+		return false, errors.Errorf("migration %d has no script for driver %s", m.Version, p.driver)
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, errors.Wrapf(err, "error starting migration %d", m.Version)
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	if p.driver == PostgresDriver {
+		// serialize migrations among concurrent server instances
+		if _, err = tx.Exec("lock table schema_migrations in exclusive mode"); err != nil {
+			return false, errors.Wrapf(err, "error locking migration %d", m.Version)
+		}
+	}
+	var count int
+	err = tx.QueryRow(p.rebind("select count(*) from schema_migrations where version = $1"), m.Version).
+		Scan(&count)
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking migration %d", m.Version)
+	}
+	if (count != 0) == up {
+		return false, nil
+	}
+
+	log.V(10).Info("Executing query", "query", script)
+	if _, err = tx.Exec(script); err != nil {
+		return false, errors.Wrapf(err, "error executing migration %d", m.Version)
+	}
+	if _, err = tx.Exec(p.rebind(record), m.Version, m.Description); err != nil {
+		return false, errors.Wrapf(err, "error recording migration %d", m.Version)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, errors.Wrapf(err, "error committing migration %d", m.Version)
+	}
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestSQLiteMigrations(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	current, err := p.CurrentSchemaVersion()
+	if err != nil {
+		t.Fatalf("reading schema version: %v", err)
+	}
+	if current != SchemaVersion() {
+		t.Errorf("got version %d, wanted %d", current, SchemaVersion())
+	}
+
+	done, err := p.MigrateUp()
+	if err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	if len(done) != 0 {
+		t.Errorf("got %d migrations applied twice", len(done))
+	}
+
+	for v := SchemaVersion(); v > 0; v-- {
+		m, err := p.MigrateDown()
+		if err != nil {
+			t.Fatalf("migrating down from %d: %v", v, err)
+		}
+		if m == nil || m.Version != v {
+			t.Fatalf("got reverted migration %+v, wanted version %d", m, v)
+		}
+	}
+
+	status, err := p.MigrationsStatus()
+	if err != nil {
+		t.Fatalf("reading migrations status: %v", err)
+	}
+	for _, s := range status {
+		if s.Applied != nil {
+			t.Errorf("migration %d still applied", s.Version)
+		}
+	}
+
+	m, err := p.MigrateDown()
+	if err != nil || m != nil {
+		t.Errorf("got %+v, %v migrating down an empty schema", m, err)
+	}
+}
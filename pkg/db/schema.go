@@ -0,0 +1,180 @@
+package db
+
+// migrations contains all database schema changes.
+// New migrations must be appended with the next version number
+// and never modified once released
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create tasks table",
+		Up: map[string]string{
+			PostgresDriver: `
+				create table if not exists tasks(
+					id serial primary key,
+					name varchar(50) not null,
+					description text,
+					category varchar(20) not null,
+					status varchar(10) not null,
+					duedate timestamp,
+					created timestamp not null default current_timestamp
+				);
+				create index if not exists tasks_status on tasks (status);`,
+			SQLiteDriver: `
+				create table if not exists tasks(
+					id integer primary key autoincrement,
+					name varchar(50) not null,
+					description text,
+					category varchar(20) not null,
+					status varchar(10) not null,
+					duedate timestamp,
+					created timestamp not null default current_timestamp
+				);
+				create index if not exists tasks_status on tasks (status);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `drop table tasks;`,
+			SQLiteDriver:   `drop table tasks;`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "add tasks version",
+		Up: map[string]string{
+			PostgresDriver: `alter table tasks add column version integer not null default 1;`,
+			SQLiteDriver:   `alter table tasks add column version integer not null default 1;`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `alter table tasks drop column version;`,
+			SQLiteDriver:   `alter table tasks drop column version;`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "create task revisions table",
+		Up: map[string]string{
+			PostgresDriver: `
+				create table task_revisions(
+					id serial primary key,
+					task_id integer not null,
+					operation varchar(10) not null,
+					old_value text,
+					new_value text,
+					created timestamp not null default current_timestamp
+				);
+				create index task_revisions_task on task_revisions (task_id, id);`,
+			SQLiteDriver: `
+				create table task_revisions(
+					id integer primary key autoincrement,
+					task_id integer not null,
+					operation varchar(10) not null,
+					old_value text,
+					new_value text,
+					created timestamp not null default current_timestamp
+				);
+				create index task_revisions_task on task_revisions (task_id, id);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `drop table task_revisions;`,
+			SQLiteDriver:   `drop table task_revisions;`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "add tasks full text search index",
+		Up: map[string]string{
+			PostgresDriver: `create index tasks_search on tasks using gin (to_tsvector('english', name || ' ' || coalesce(description, '')));`,
+			// SQLite search falls back to like expressions, which can't use an index
+			SQLiteDriver: `select 1;`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `drop index tasks_search;`,
+			SQLiteDriver:   `select 1;`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "add tenant to tasks and revisions",
+		Up: map[string]string{
+			PostgresDriver: `
+				alter table tasks add column tenant varchar(50) not null default 'default';
+				alter table task_revisions add column tenant varchar(50) not null default 'default';
+				create index tasks_tenant on tasks (tenant, id);`,
+			SQLiteDriver: `
+				alter table tasks add column tenant varchar(50) not null default 'default';
+				alter table task_revisions add column tenant varchar(50) not null default 'default';
+				create index tasks_tenant on tasks (tenant, id);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `
+				drop index tasks_tenant;
+				alter table task_revisions drop column tenant;
+				alter table tasks drop column tenant;`,
+			SQLiteDriver: `
+				drop index tasks_tenant;
+				alter table task_revisions drop column tenant;
+				alter table tasks drop column tenant;`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "create task events outbox table",
+		Up: map[string]string{
+			PostgresDriver: `
+				create table task_events(
+					id serial primary key,
+					tenant varchar(50) not null,
+					operation varchar(10) not null,
+					task text not null,
+					created timestamp not null default current_timestamp
+				);
+				create index task_events_created on task_events (created);`,
+			SQLiteDriver: `
+				create table task_events(
+					id integer primary key autoincrement,
+					tenant varchar(50) not null,
+					operation varchar(10) not null,
+					task text not null,
+					created timestamp not null default current_timestamp
+				);
+				create index task_events_created on task_events (created);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `drop table task_events;`,
+			SQLiteDriver:   `drop table task_events;`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "add deleted timestamp to tasks",
+		Up: map[string]string{
+			PostgresDriver: `
+				alter table tasks add column deleted_at timestamp;
+				update tasks set deleted_at = current_timestamp where status = 'deleted';
+				create index tasks_deleted_at on tasks (deleted_at);`,
+			SQLiteDriver: `
+				alter table tasks add column deleted_at timestamp;
+				update tasks set deleted_at = current_timestamp where status = 'deleted';
+				create index tasks_deleted_at on tasks (deleted_at);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `
+				drop index tasks_deleted_at;
+				alter table tasks drop column deleted_at;`,
+			SQLiteDriver: `
+				drop index tasks_deleted_at;
+				alter table tasks drop column deleted_at;`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "add status before deletion to tasks",
+		Up: map[string]string{
+			PostgresDriver: `alter table tasks add column previous_status varchar(20);`,
+			SQLiteDriver:   `alter table tasks add column previous_status varchar(20);`,
+		},
+		Down: map[string]string{
+			PostgresDriver: `alter table tasks drop column previous_status;`,
+			SQLiteDriver:   `alter table tasks drop column previous_status;`,
+		},
+	},
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// TaskCursor returns the cursor pointing to a task for the order items,
+// to be used for requesting the listing page that follows it
+func TaskCursor(items []clauses.OrderItem, t *types.Task) (string, error) {
+	values := make([]*string, 0, len(items))
+	for _, o := range items {
+		fv, err := taskFieldValue(t, o.Field)
+		if err != nil {
+			return "", errors.Wrap(err, "error building cursor")
+		}
+		var value string
+		switch v := fv.(type) {
+		case int:
+			value = strconv.Itoa(v)
+		case string:
+			value = v
+		case *time.Time:
+			if v == nil {
+				values = append(values, nil)
+				continue
+			}
+			value = v.Format(time.RFC3339Nano)
+		default:
+			return "", errors.Errorf("cursor field %s type is not supported", o.Field)
+		}
+		values = append(values, &value)
+	}
+	return clauses.EncodeCursor(items, values)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -12,194 +13,547 @@ import (
 )
 
 // SelectTasks executes a tasks query at the database
-func (p PersistenceManager) SelectTasks(q *clauses.Query) ([]types.Task, error) {
+func (p *PersistenceManager) SelectTasks(ctx context.Context, q *clauses.Query) ([]types.Task, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := queryColumns(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Tasks")
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
 
-	query := `
-		select
-			id, 
-			name, 
-			description, 
-			category, 
-			status, 
-			duedate,
-			created
-		from tasks`
+	query := fmt.Sprintf("select %s from tasks", strings.Join(columns, ", "))
 
-	if len(q.Where) != 0 {
-		query = fmt.Sprintf("%s where %s", query, q.Where)
-	}
-	if len(q.Pagination) != 0 {
-		query = fmt.Sprintf("%s %s", query, q.Pagination)
+	where, params, orderBy := p.tasksWhere(q, tenantID)
+	query = fmt.Sprintf("%s where %s", query, where)
+	if len(orderBy) != 0 {
+		query = fmt.Sprintf("%s order by %s", query, orderBy)
 	}
-	if len(q.OrderByClause) != 0 {
-		query = fmt.Sprintf("%s order by %s", query, q.OrderByClause)
+	if pag := p.paginationClause(q); len(pag) != 0 {
+		query = fmt.Sprintf("%s %s", query, pag)
 	}
 
 	log.V(10).Info("Executing query",
 		"query", query,
-		"parameters", q.WhereParams)
+		"parameters", params)
 
-	stmt, err := p.db.Prepare(query)
+	stmt, err := p.prepare(ctx, p.reader(ctx), query)
 	if err != nil {
-		return nil, errors.Wrap(err, "error preparing SelectTasks statement")
+		return nil, wrapError(ctx, err, "error preparing SelectTasks statement")
 	}
+	defer stmt.Close()
 
-	rows, err := stmt.Query(q.WhereParams...)
+	rows, err := stmt.QueryContext(ctx, params...)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "error retrieving Tasks")
+		return nil, wrapError(ctx, err, "error retrieving Tasks")
 	}
 	defer rows.Close()
 
 	items := []types.Task{}
 	for rows.Next() {
 		item := types.Task{}
-		if rows.Scan(
-			&item.ID,
-			&item.Name,
-			&item.Description,
-			&item.Category,
-			&item.Status,
-			&item.DueDate,
-			&item.Created) != nil {
-			return nil, errors.Wrap(err, "error scanning Tasks")
+		dest := make([]interface{}, len(columns))
+		for i, c := range columns {
+			dest[i], _ = taskFieldPointer(&item, c)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, wrapError(ctx, err, "error scanning Tasks")
 		}
 		items = append(items, item)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapError(ctx, err, "error retrieving Tasks")
+	}
 	return items, nil
 }
 
+// CountTasks returns the number of tasks matching a query,
+// ignoring pagination
+func (p *PersistenceManager) CountTasks(ctx context.Context, q *clauses.Query) (int, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	where, params, _ := p.tasksWhere(q, tenantID)
+	query := fmt.Sprintf("select count(*) from tasks where %s", where)
+
+	log.V(10).Info("Executing query",
+		"query", query,
+		"parameters", params)
+
+	stmt, err := p.prepare(ctx, p.reader(ctx), query)
+	if err != nil {
+		return 0, wrapError(ctx, err, "error preparing CountTasks statement")
+	}
+	defer stmt.Close()
+
+	var count int
+	if err = stmt.QueryRowContext(ctx, params...).Scan(&count); err != nil {
+		return 0, wrapError(ctx, err, "error counting Tasks")
+	}
+	return count, nil
+}
+
+// tasksWhere returns the where clause, its parameters and the order by
+// clause for a tasks query, combining filters with the tenant and search terms
+func (p *PersistenceManager) tasksWhere(q *clauses.Query, tenantID string) (string, []interface{}, string) {
+	params := append([]interface{}{}, q.WhereParams...)
+	params = append(params, tenantID)
+	where := fmt.Sprintf("tenant = $%d", len(params))
+	// the query clause is grouped so that none of its terms
+	// can match tasks of other tenants
+	if len(q.Where) != 0 {
+		where = fmt.Sprintf("(%s) and %s", q.Where, where)
+	}
+
+	orderBy := q.OrderByClause
+	if len(q.Search) == 0 {
+		return where, params, orderBy
+	}
+
+	search, rank, params := p.searchClause(q.Search, params)
+	where = fmt.Sprintf("%s and %s", where, search)
+	// explicit ordering takes precedence over relevance
+	if len(orderBy) == 0 {
+		orderBy = rank
+	}
+	return where, params, orderBy
+}
+
 // GetTask from the database
 // If object by ID doesn't exists, nil is returned
-func (p *PersistenceManager) GetTask(ID int) (*types.Task, error) {
-	query := `
-		select
-			name, 
-			description, 
-			category, 
-			status, 
-			duedate,
-			created
-		from tasks
-		where id = $1`
+func (p *PersistenceManager) GetTask(ctx context.Context, ID int, fields ...string) (*types.Task, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+	return p.getTask(ctx, p.reader(ctx), tenantID, ID, fields...)
+}
+
+// getTask retrieves a tenant task using a database or transaction,
+// limited to the fields columns if any
+func (p *PersistenceManager) getTask(ctx context.Context, ex executor, tenantID string, ID int, fields ...string) (*types.Task, error) {
+	columns, err := selectedColumns(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Task")
+	}
 	item := &types.Task{ID: ID}
+	// the ID is already known
+	dest := []interface{}{}
+	selected := []string{}
+	for _, c := range columns {
+		if c == "id" {
+			continue
+		}
+		fp, _ := taskFieldPointer(item, c)
+		dest = append(dest, fp)
+		selected = append(selected, c)
+	}
+	query := fmt.Sprintf("select %s from tasks where id = $1 and tenant = $2", strings.Join(selected, ", "))
 
 	log.V(10).Info("Executing query",
 		"query", query,
 		"ID", ID)
-	stmt, err := p.db.Prepare(query)
+	stmt, err := p.prepare(ctx, ex, query)
 	if err != nil {
-		return nil, errors.Wrap(err, "error preparing GetTask statement")
+		return nil, wrapError(ctx, err, "error preparing GetTask statement")
 	}
+	defer stmt.Close()
 
-	err = stmt.QueryRow(item.ID).Scan(
-		&item.Name,
-		&item.Description,
-		&item.Category,
-		&item.Status,
-		&item.DueDate,
-		&item.Created)
+	err = stmt.QueryRowContext(ctx, item.ID, tenantID).Scan(dest...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, errors.Wrap(err, "error scanning Task")
+		return nil, wrapError(ctx, err, "error scanning Task")
 	}
 	return item, nil
 }
 
 // CreateTask at the database
-func (p *PersistenceManager) CreateTask(item *types.Task) (*types.Task, error) {
+func (p *PersistenceManager) CreateTask(ctx context.Context, item *types.Task) (*types.Task, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error starting CreateTask transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	if p.driver == SQLiteDriver {
+		err = p.createTaskNoReturning(ctx, tx, tenantID, item)
+	} else {
+		err = p.createTask(ctx, tx, tenantID, item)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.recordRevision(ctx, tx, tenantID, types.OperationCreate, item.ID, nil, item); err != nil {
+		return nil, err
+	}
+	if err = p.recordTaskEvent(ctx, tx, tenantID, types.OperationCreate, item); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, wrapError(ctx, err, "error committing CreateTask transaction")
+	}
+	p.dispatcher.wake()
+	return item, nil
+}
+
+// createTask inserts a task reading generated values
+// through the returning clause
+func (p *PersistenceManager) createTask(ctx context.Context, ex executor, tenantID string, item *types.Task) error {
 	query := `
 		insert into tasks
 		(
-			name, 
-			description, 
-			category, 
-			status, 
-			duedate
+			name,
+			description,
+			category,
+			status,
+			duedate,
+			tenant,
+			deleted_at
 		)
 		values
-			($1, $2, $3, $4, $5)
+			($1, $2, $3, $4, $5, $6, case when $4 = 'deleted' then current_timestamp end)
 		returning
-			id, created`
+			id, created, version`
 	log.V(10).Info("Executing query",
 		"query", query,
 		"parameters", item)
 
-	stmt, err := p.db.Prepare(query)
+	stmt, err := p.prepare(ctx, ex, query)
 	if err != nil {
-		return nil, errors.Wrap(err, "error preparing CreateTask statement")
+		return wrapError(ctx, err, "error preparing CreateTask statement")
 	}
+	defer stmt.Close()
 
-	err = stmt.QueryRow(
+	err = stmt.QueryRowContext(ctx,
 		item.Name,
 		item.Description,
 		item.Category,
 		strings.ToLower(item.Status),
-		item.DueDate).
+		item.DueDate,
+		tenantID).
 		Scan(
 			&item.ID,
-			&item.Created)
+			&item.Created,
+			&item.Version)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating Task")
+		return wrapError(ctx, err, "error creating Task")
 	}
-	return item, nil
+	return nil
 }
 
-// UpdateOneTask object at the database
-func (p *PersistenceManager) UpdateOneTask(item *types.Task) (*types.Task, error) {
+// createTaskNoReturning creates a task for databases that don't support
+// the returning clause, reading generated values after inserting
+func (p *PersistenceManager) createTaskNoReturning(ctx context.Context, ex executor, tenantID string, item *types.Task) error {
+	query := `
+		insert into tasks
+		(
+			name,
+			description,
+			category,
+			status,
+			duedate,
+			tenant,
+			deleted_at
+		)
+		values
+			($1, $2, $3, $4, $5, $6, case when $4 = 'deleted' then current_timestamp end)`
+	log.V(10).Info("Executing query",
+		"query", query,
+		"parameters", item)
+
+	stmt, err := p.prepare(ctx, ex, query)
+	if err != nil {
+		return wrapError(ctx, err, "error preparing CreateTask statement")
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx,
+		item.Name,
+		item.Description,
+		item.Category,
+		strings.ToLower(item.Status),
+		item.DueDate,
+		tenantID)
+	if err != nil {
+		return wrapError(ctx, err, "error creating Task")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "error retrieving created Task ID")
+	}
+	item.ID = int(id)
+
+	err = ex.QueryRowContext(ctx,
+		p.rebind("select created, version from tasks where id = $1"), item.ID).
+		Scan(&item.Created, &item.Version)
+	if err != nil {
+		return wrapError(ctx, err, "error retrieving created Task")
+	}
+	return nil
+}
+
+// UpdateOneTask object at the database.
+// The update only succeeds if the stored version matches the item version,
+// otherwise ErrVersionConflict is returned
+func (p *PersistenceManager) UpdateOneTask(ctx context.Context, item *types.Task) (*types.Task, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error starting UpdateOneTask transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	old, err := p.getTask(ctx, tx, tenantID, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil || old.Version != item.Version {
+		return nil, ErrVersionConflict
+	}
+
 	query := `
 		update tasks set
 			name = $1,
 			description = $2,
 			category = $3,
 			status = $4,
-			duedate = $5
+			duedate = $5,
+			version = version + 1,
+			deleted_at = case when $4 = 'deleted' then coalesce(deleted_at, current_timestamp) end,
+			previous_status = case
+				when $4 <> 'deleted' then null
+				when status <> 'deleted' then status
+				else previous_status
+			end
 		where
-			id = $6`
+			id = $6 and version = $7 and tenant = $8`
 	log.V(10).Info("Executing query",
 		"query", query,
 		"parameters", item)
 
-	stmt, err := p.db.Prepare(query)
+	stmt, err := p.prepare(ctx, tx, query)
 	if err != nil {
-		return nil, errors.Wrap(err, "error preparing UpdateOneTask statement")
+		return nil, wrapError(ctx, err, "error preparing UpdateOneTask statement")
 	}
+	defer stmt.Close()
 
-	_, err = stmt.Exec(
+	res, err := stmt.ExecContext(ctx,
 		item.Name,
 		item.Description,
 		item.Category,
 		strings.ToLower(item.Status),
 		item.DueDate,
-		item.ID)
+		item.ID,
+		item.Version,
+		tenantID)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "error updating Task")
+		return nil, wrapError(ctx, err, "error updating Task")
+	}
+	if err = checkVersionMatched(res); err != nil {
+		return nil, err
+	}
+
+	updated := *item
+	updated.Status = strings.ToLower(item.Status)
+	updated.Version++
+	if err = p.recordRevision(ctx, tx, tenantID, types.OperationUpdate, item.ID, old, &updated); err != nil {
+		return nil, err
 	}
+	if err = p.recordTaskEvent(ctx, tx, tenantID, types.OperationUpdate, &updated); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, wrapError(ctx, err, "error committing UpdateOneTask transaction")
+	}
+	p.dispatcher.wake()
+	item.Version++
 	return item, nil
 }
 
-// DeleteOneTask object at the database
-func (p *PersistenceManager) DeleteOneTask(ID int) error {
+// DeleteOneTask object at the database.
+// The delete only succeeds if the stored version matches,
+// otherwise ErrVersionConflict is returned
+func (p *PersistenceManager) DeleteOneTask(ctx context.Context, ID, version int) error {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(ctx, err, "error starting DeleteOneTask transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	old, err := p.getTask(ctx, tx, tenantID, ID)
+	if err != nil {
+		return err
+	}
+	if old == nil || old.Version != version {
+		return ErrVersionConflict
+	}
+
 	query := `
 		delete from tasks
 		where
-		id = $1`
+		id = $1 and version = $2 and tenant = $3`
 	log.V(10).Info("Executing query",
 		"query", query,
-		"ID", ID)
+		"ID", ID,
+		"version", version)
+
+	stmt, err := p.prepare(ctx, tx, query)
+	if err != nil {
+		return wrapError(ctx, err, "error preparing DeleteOneTask statement")
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, ID, version, tenantID)
+	if err != nil {
+		return wrapError(ctx, err, "error deleting Tasks")
+	}
+	if err = checkVersionMatched(res); err != nil {
+		return err
+	}
+
+	if err = p.recordRevision(ctx, tx, tenantID, types.OperationDelete, ID, old, nil); err != nil {
+		return err
+	}
+	if err = p.recordTaskEvent(ctx, tx, tenantID, types.OperationDelete, old); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return wrapError(ctx, err, "error committing DeleteOneTask transaction")
+	}
+	p.dispatcher.wake()
+	return nil
+}
+
+// RestoreTask puts a logically deleted task back to the status it had
+// before being deleted, pending if it is unknown.
+// The restore only succeeds if the stored version matches,
+// otherwise ErrVersionConflict is returned
+func (p *PersistenceManager) RestoreTask(ctx context.Context, ID, version int) (*types.Task, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error starting RestoreTask transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	old, err := p.getTask(ctx, tx, tenantID, ID)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil || old.Version != version {
+		return nil, ErrVersionConflict
+	}
+	if old.Status != types.StatusDeleted {
+		return nil, ErrNotDeleted
+	}
+
+	query := `
+		update tasks set
+			status = coalesce(previous_status, 'pending'),
+			previous_status = null,
+			deleted_at = null,
+			version = version + 1
+		where
+			id = $1 and version = $2 and tenant = $3`
+	log.V(10).Info("Executing query",
+		"query", query,
+		"ID", ID,
+		"version", version)
+
+	stmt, err := p.prepare(ctx, tx, query)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error preparing RestoreTask statement")
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, ID, version, tenantID)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error restoring Task")
+	}
+	if err = checkVersionMatched(res); err != nil {
+		return nil, err
+	}
 
-	stmt, err := p.db.Prepare(query)
+	restored, err := p.getTask(ctx, tx, tenantID, ID)
 	if err != nil {
-		return errors.Wrap(err, "error preparing DeleteOneTask statement")
+		return nil, err
 	}
+	if err = p.recordRevision(ctx, tx, tenantID, types.OperationUpdate, ID, old, restored); err != nil {
+		return nil, err
+	}
+	if err = p.recordTaskEvent(ctx, tx, tenantID, types.OperationUpdate, restored); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, wrapError(ctx, err, "error committing RestoreTask transaction")
+	}
+	p.dispatcher.wake()
+	return restored, nil
+}
 
-	_, err = stmt.Exec(ID)
+// checkVersionMatched returns ErrVersionConflict if a conditional
+// statement didn't affect any row
+func checkVersionMatched(res sql.Result) error {
+	n, err := res.RowsAffected()
 	if err != nil {
-		return errors.Wrap(err, "error deleting Tasks")
+		return errors.Wrap(err, "error reading affected Tasks")
+	}
+	if n == 0 {
+		return ErrVersionConflict
 	}
 	return nil
 }
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// newSQLiteTestManager returns a persistence manager on an
+// in memory SQLite database. Tests are skipped when built without cgo,
+// which the sqlite driver needs, except at CI where they must run
+func newSQLiteTestManager(t *testing.T) *PersistenceManager {
+	connDB, err := ConnectSQLiteDB(":memory:")
+	if err != nil {
+		if strings.Contains(err.Error(), "cgo") && os.Getenv("CI") == "" {
+			t.Skip("sqlite driver needs cgo")
+		}
+		t.Fatalf("connecting to sqlite: %v", err)
+	}
+	p := NewSQLitePersistenceManager(connDB)
+	if _, err = p.MigrateUp(); err != nil {
+		t.Fatalf("migrating sqlite: %v", err)
+	}
+	return p
+}
+
+func TestSQLiteTaskLifecycle(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	for _, name := range []string{"b", "a", "c"} {
+		task, err := p.CreateTask(testContext, &types.Task{Name: name, Category: "home", Status: "Pending"})
+		if err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+		if task.ID == 0 || task.Created == nil {
+			t.Errorf("missing generated values at %+v", task)
+		}
+	}
+
+	q, err := clauses.BuildQueryClauseFromRequest(
+		map[string]string{"status": "pending", "order": "name:desc", "page": "1", "page_size": "2"},
+		[]clauses.AllowedWhere{{URLField: "status", DBField: "status", Type: "string"}},
+		testAllowedOrder)
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	tasks, err := p.SelectTasks(testContext, q)
+	if err != nil {
+		t.Fatalf("selecting tasks: %v", err)
+	}
+	if len(tasks) != 2 || tasks[0].Name != "c" || tasks[1].Name != "b" {
+		t.Errorf("unexpected tasks %+v", tasks)
+	}
+
+	task := &tasks[0]
+	task.Status = types.StatusStarted
+	if _, err = p.UpdateOneTask(testContext, task); err != nil {
+		t.Fatalf("updating task: %v", err)
+	}
+	stale := *task
+	stale.Version--
+	if _, err = p.UpdateOneTask(testContext, &stale); err != ErrVersionConflict {
+		t.Errorf("got %v updating a stale task, wanted %v", err, ErrVersionConflict)
+	}
+	got, err := p.GetTask(testContext, task.ID)
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if got == nil || got.Status != types.StatusStarted {
+		t.Errorf("got %+v, wanted started task", got)
+	}
+
+	if err = p.DeleteOneTask(testContext, task.ID, task.Version); err != nil {
+		t.Fatalf("deleting task: %v", err)
+	}
+	got, err = p.GetTask(testContext, task.ID)
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if got != nil {
+		t.Errorf("got %+v, wanted deleted task", got)
+	}
+
+	revisions, err := p.TaskHistory(testContext, task.ID, &clauses.Query{})
+	if err != nil {
+		t.Fatalf("getting task history: %v", err)
+	}
+	operations := []string{}
+	for _, r := range revisions {
+		operations = append(operations, r.Operation)
+	}
+	if strings.Join(operations, ",") != "create,update,delete" {
+		t.Errorf("got history %v, wanted create,update,delete", operations)
+	}
+	if revisions[1].Old.Status != types.StatusPending || revisions[1].New.Status != types.StatusStarted {
+		t.Errorf("unexpected update revision %+v", revisions[1])
+	}
+}
+
+func TestSQLiteCursorPagination(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	for _, name := range []string{"b", "a", "b", "c", "a"} {
+		if _, err := p.CreateTask(testContext, &types.Task{Name: name, Category: "home", Status: types.StatusPending}); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	ids := selectPages(t, p, map[string]string{"order": "name:desc", "page_size": "2"})
+	if fmt.Sprint(ids) != fmt.Sprint([]int{4, 1, 3, 2, 5}) {
+		t.Errorf("got %v, wanted %v", ids, []int{4, 1, 3, 2, 5})
+	}
+}
+
+func TestSQLiteRestoreTask(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkRestoreTask(t, p)
+}
+
+func TestSQLiteDateFilters(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkDateFilters(t, p)
+}
+
+func TestSQLiteFilterExpression(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkFilterExpression(t, p)
+}
+
+func TestSQLiteTaskFields(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkTaskFields(t, p)
+}
+
+func TestSQLiteNullOrdering(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkNullOrdering(t, p)
+}
+
+func TestSQLiteTenantIsolation(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkTenantIsolation(t, p)
+}
+
+func TestSQLiteTenantOrFilter(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkTenantOrFilter(t, p)
+
+	// the tenant condition applies to all terms of
+	// where clauses that are not grouped
+	teamB := tenant.NewContext(context.Background(), "team-b")
+	q := &clauses.Query{Where: "name = $1 or name = $2", WhereParams: []interface{}{"a", "b"}}
+	tasks, err := p.SelectTasks(teamB, q)
+	if err != nil {
+		t.Fatalf("selecting tasks: %v", err)
+	}
+	for _, task := range tasks {
+		if task.ID != 3 && task.ID != 4 && task.ID != 7 && task.ID != 8 {
+			t.Errorf("got other tenant task %+v", task)
+		}
+	}
+	if len(tasks) != 4 {
+		t.Errorf("got %d tasks, wanted 4", len(tasks))
+	}
+}
+
+func TestSQLiteReplicaReads(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+	// an empty replica shows which database each read is sent to
+	replica := newSQLiteTestManager(t)
+	defer replica.db.Close()
+	p.SetReplica(replica.db)
+
+	task, err := p.CreateTask(testContext, &types.Task{Name: "a", Status: types.StatusPending})
+	if err != nil {
+		t.Fatalf("creating task: %v", err)
+	}
+
+	q := &clauses.Query{}
+	var testData = []struct {
+		testName      string
+		primary       bool
+		expectedTasks int
+	}{
+		{
+			testName:      "reads from replica",
+			primary:       false,
+			expectedTasks: 0,
+		},
+		{
+			testName:      "reads from primary",
+			primary:       true,
+			expectedTasks: 1,
+		},
+	}
+
+	for _, td := range testData {
+		ctx := testContext
+		if td.primary {
+			ctx = WithPrimary(ctx)
+		}
+		tasks, err := p.SelectTasks(ctx, q)
+		if err != nil {
+			t.Fatalf("%q: selecting tasks: %v", td.testName, err)
+		}
+		if len(tasks) != td.expectedTasks {
+			t.Errorf("%q: got %d listed tasks, wanted %d", td.testName, len(tasks), td.expectedTasks)
+		}
+		got, err := p.GetTask(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("%q: getting task: %v", td.testName, err)
+		}
+		if (got != nil) != (td.expectedTasks != 0) {
+			t.Errorf("%q: got task %+v", td.testName, got)
+		}
+	}
+
+	// writes always read the latest version from the primary
+	task.Name = "b"
+	if _, err = p.UpdateOneTask(testContext, task); err != nil {
+		t.Errorf("updating task: %v", err)
+	}
+}
+
+func TestSQLiteFilterOperators(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	for _, name := range []string{"buy milk", "buy 100% milk", "sell car"} {
+		if _, err := p.CreateTask(testContext, &types.Task{Name: name, Category: "home", Status: types.StatusPending}); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer", Operators: []string{"ne", "in"}},
+		{URLField: "name", DBField: "name", Type: "string", Operators: []string{"like"}},
+	}
+	var filterTests = []struct {
+		values      map[string]string
+		expectedIDs []int
+	}{
+		{map[string]string{"id[in]": "1,3"}, []int{1, 3}},
+		{map[string]string{"id[ne]": "1"}, []int{2, 3}},
+		{map[string]string{"name[like]": "buy*"}, []int{1, 2}},
+		{map[string]string{"name[like]": "*100%*"}, []int{2}},
+	}
+
+	for _, ft := range filterTests {
+		q, err := clauses.BuildQueryClauseFromRequest(ft.values, allowedWhere, nil)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		tasks, err := p.SelectTasks(testContext, q)
+		if err != nil {
+			t.Fatalf("selecting tasks: %v", err)
+		}
+		ids := []int{}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(ft.expectedIDs) {
+			t.Errorf("%v: got %v, wanted %v", ft.values, ids, ft.expectedIDs)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// taskEventsChannel is the Postgres notification channel used to wake up
+// the dispatchers of all server instances when task events are recorded
+const taskEventsChannel = "task_events"
+
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+	listenerPingInterval = 90 * time.Second
+
+	// dispatcherPollInterval is the longest a recorded event waits
+	// to be dispatched when no wake up is received
+	dispatcherPollInterval = 5 * time.Second
+	// dispatcherBatchSize is the number of events read from the outbox at once
+	dispatcherBatchSize = 100
+	// dispatcherGapTimeout is how long the dispatcher waits for a missing
+	// event ID to be committed before dispatching the events after it
+	dispatcherGapTimeout = 5 * time.Second
+	// dispatcherLookback is how many IDs behind the position skipped
+	// events are looked for, so that late commits are still delivered
+	dispatcherLookback = 1000
+	// dispatcherMissingTimeout is how long skipped events are looked for,
+	// IDs of rolled back transactions are never committed
+	dispatcherMissingTimeout = 10 * time.Minute
+	// taskEventsRetention is how long events are kept at the outbox
+	taskEventsRetention = time.Hour
+	// taskEventsPurgeInterval is how often expired events are removed
+	taskEventsPurgeInterval = 10 * time.Minute
+)
+
+// TaskEventSource is implemented by stores that publish the changes
+// made to tasks by any server instance sharing the store
+type TaskEventSource interface {
+	// TaskEvents returns the channel where changes are published in order,
+	// changes committed late might be published after later ones
+	TaskEvents() <-chan types.TaskEvent
+}
+
+var (
+	_ TaskEventSource = &PersistenceManager{}
+	_ TaskEventSource = &MemoryPersistenceManager{}
+)
+
+// taskEventOutbox is implemented by stores that record task events
+// in the same transaction that modifies tasks
+type taskEventOutbox interface {
+	// lastTaskEvent returns the ID of the last recorded event, 0 if none
+	lastTaskEvent(ctx context.Context) (int, error)
+	// taskEventsAfter returns up to limit events recorded after ID, in order
+	taskEventsAfter(ctx context.Context, ID, limit int) ([]types.TaskEvent, error)
+	// purgeTaskEvents removes events recorded before a time
+	purgeTaskEvents(ctx context.Context, before time.Time) error
+}
+
+// eventDispatcher delivers the events recorded at an outbox in order.
+// An event is only considered dispatched once it has been delivered,
+// if reading the outbox fails it is retried at the next poll.
+// Missing IDs skipped after a timeout keep being looked for, and are
+// delivered out of order if their transaction commits later.
+// Events recorded before the dispatcher starts are not delivered
+type eventDispatcher struct {
+	outbox taskEventOutbox
+	events chan types.TaskEvent
+	wakeup chan struct{}
+	once   sync.Once
+	// missing holds skipped IDs and the time they were found missing
+	missing map[int]time.Time
+}
+
+// newEventDispatcher returns a dispatcher for an outbox, not yet started
+func newEventDispatcher(outbox taskEventOutbox) *eventDispatcher {
+	return &eventDispatcher{
+		outbox:  outbox,
+		events:  make(chan types.TaskEvent),
+		wakeup:  make(chan struct{}, 1),
+		missing: map[int]time.Time{},
+	}
+}
+
+// start runs the dispatcher the first time it is called,
+// returning the channel events are delivered to
+func (d *eventDispatcher) start() <-chan types.TaskEvent {
+	d.once.Do(func() {
+		go d.loop()
+	})
+	return d.events
+}
+
+// wake makes the dispatcher check the outbox without waiting for the
+// next poll. It never blocks and is a no-op for a nil dispatcher
+func (d *eventDispatcher) wake() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *eventDispatcher) loop() {
+	ctx := context.Background()
+
+	var (
+		position int
+		err      error
+	)
+	for {
+		if position, err = d.outbox.lastTaskEvent(ctx); err == nil {
+			break
+		}
+		log.Error(err, "error reading task events outbox position")
+		time.Sleep(dispatcherPollInterval)
+	}
+	log.V(5).Info("dispatching task events", "position", position)
+
+	poll := time.NewTicker(dispatcherPollInterval)
+	defer poll.Stop()
+
+	var gapSince time.Time
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-d.wakeup:
+		case <-poll.C:
+		}
+		position, gapSince = d.dispatch(ctx, position, gapSince)
+
+		if time.Since(lastPurge) > taskEventsPurgeInterval {
+			if err = d.outbox.purgeTaskEvents(ctx, time.Now().Add(-taskEventsRetention)); err != nil {
+				log.Error(err, "error purging task events outbox")
+			}
+			lastPurge = time.Now()
+		}
+	}
+}
+
+// dispatch delivers the events recorded after position, returning the
+// position of the last delivered event and the time the dispatcher
+// started waiting for a missing event, if any
+func (d *eventDispatcher) dispatch(ctx context.Context, position int, gapSince time.Time) (int, time.Time) {
+	d.dispatchMissing(ctx, position)
+
+	for {
+		events, err := d.outbox.taskEventsAfter(ctx, position, dispatcherBatchSize)
+		if err != nil {
+			log.Error(err, "error reading task events outbox", "position", position)
+			return position, gapSince
+		}
+
+		for _, event := range events {
+			if event.ID != position+1 {
+				// IDs are allocated on insert but become visible on commit,
+				// a missing ID might belong to a transaction still in progress
+				// or to one that was rolled back
+				if gapSince.IsZero() {
+					gapSince = time.Now()
+				}
+				if time.Since(gapSince) < dispatcherGapTimeout {
+					return position, gapSince
+				}
+				log.Info("skipping missing task events", "from", position+1, "to", event.ID-1)
+				for ID := position + 1; ID < event.ID; ID++ {
+					if ID > event.ID-1-dispatcherLookback {
+						d.missing[ID] = gapSince
+					}
+				}
+			}
+			log.V(10).Info("dispatching task event", "id", event.ID, "operation", event.Operation)
+			d.events <- event
+			position, gapSince = event.ID, time.Time{}
+		}
+
+		if len(events) < dispatcherBatchSize {
+			return position, gapSince
+		}
+	}
+}
+
+// dispatchMissing delivers skipped events that have been committed since,
+// forgetting those too far behind position or missing for too long
+func (d *eventDispatcher) dispatchMissing(ctx context.Context, position int) {
+	from := position
+	for ID, since := range d.missing {
+		if ID <= position-dispatcherLookback || time.Since(since) > dispatcherMissingTimeout {
+			log.V(5).Info("forgetting missing task event", "id", ID)
+			delete(d.missing, ID)
+			continue
+		}
+		if ID <= from {
+			from = ID - 1
+		}
+	}
+
+	for from < position && len(d.missing) != 0 {
+		events, err := d.outbox.taskEventsAfter(ctx, from, dispatcherBatchSize)
+		if err != nil {
+			log.Error(err, "error reading task events outbox", "position", from)
+			return
+		}
+
+		for _, event := range events {
+			if event.ID > position {
+				return
+			}
+			from = event.ID
+			if _, ok := d.missing[event.ID]; !ok {
+				continue
+			}
+			log.V(10).Info("dispatching late task event", "id", event.ID, "operation", event.Operation)
+			d.events <- event
+			delete(d.missing, event.ID)
+		}
+
+		if len(events) < dispatcherBatchSize {
+			return
+		}
+	}
+}
+
+// TaskEvents returns the channel where changes recorded by all server
+// instances are published, starting the events dispatcher
+func (p *PersistenceManager) TaskEvents() <-chan types.TaskEvent {
+	return p.dispatcher.start()
+}
+
+// ListenTaskEvents subscribes to the Postgres notifications sent when any server
+// instance records task events, so that they are dispatched without waiting
+// for the next outbox poll
+func (p *PersistenceManager) ListenTaskEvents(host string, port int, user, pass, database string, dbSSL bool) error {
+	if p.driver != PostgresDriver {
+		return errors.Errorf("task events are not supported for driver %s", p.driver)
+	}
+
+	dataSource := postgresDataSource(host, port, user, database, dbSSL)
+	log.V(5).Info("listening to database notifications",
+		"datasource (password not shown)", dataSource,
+		"channel", taskEventsChannel)
+	dataSource += fmt.Sprintf(" password=%s", pass)
+
+	listener := pq.NewListener(dataSource, listenerMinReconnect, listenerMaxReconnect,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Error(err, "task events listener", "event", ev)
+			}
+		})
+	if err := listener.Listen(taskEventsChannel); err != nil {
+		_ = listener.Close()
+		return errors.Wrapf(err, "error listening to %s notifications", taskEventsChannel)
+	}
+
+	go p.listenerLoop(listener)
+	return nil
+}
+
+// listenerLoop wakes up the dispatcher on database notifications
+func (p *PersistenceManager) listenerLoop(listener *pq.Listener) {
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// connection was re-established, events recorded while
+				// disconnected are read from the outbox
+				log.Info("task events listener reconnected")
+			}
+			p.dispatcher.wake()
+
+		case <-time.After(listenerPingInterval):
+			go func() {
+				if err := listener.Ping(); err != nil {
+					log.Error(err, "task events listener ping")
+				}
+			}()
+		}
+	}
+}
+
+// recordTaskEvent writes a task change to the events outbox, it must
+// be executed at the transaction that modifies the task.
+// For Postgres, listening server instances are notified on commit
+func (p *PersistenceManager) recordTaskEvent(ctx context.Context, ex executor, tenantID, operation string, task *types.Task) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling task event")
+	}
+
+	query := `
+		insert into task_events
+			(tenant, operation, task)
+		values
+			($1, $2, $3)`
+	log.V(10).Info("Executing query",
+		"query", query,
+		"operation", operation)
+
+	if _, err = ex.ExecContext(ctx, p.rebind(query), tenantID, operation, string(payload)); err != nil {
+		return wrapError(ctx, err, "error recording task event")
+	}
+
+	if p.driver != PostgresDriver {
+		return nil
+	}
+	if _, err = ex.ExecContext(ctx, "select pg_notify($1, '')", taskEventsChannel); err != nil {
+		return wrapError(ctx, err, "error notifying task event")
+	}
+	return nil
+}
+
+// lastTaskEvent returns the ID of the last recorded event, 0 if none
+func (p *PersistenceManager) lastTaskEvent(ctx context.Context) (int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var ID int
+	err := p.db.QueryRowContext(ctx, "select coalesce(max(id), 0) from task_events").Scan(&ID)
+	if err != nil {
+		return 0, wrapError(ctx, err, "error reading last task event")
+	}
+	return ID, nil
+}
+
+// taskEventsAfter returns up to limit events recorded after ID, in order
+func (p *PersistenceManager) taskEventsAfter(ctx context.Context, ID, limit int) ([]types.TaskEvent, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			id,
+			tenant,
+			operation,
+			task
+		from task_events
+		where id > $1
+		order by id
+		limit $2`
+	log.V(10).Info("Executing query",
+		"query", query,
+		"ID", ID)
+
+	rows, err := p.db.QueryContext(ctx, p.rebind(query), ID, limit)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error retrieving task events")
+	}
+	defer rows.Close()
+
+	events := []types.TaskEvent{}
+	for rows.Next() {
+		var (
+			event   types.TaskEvent
+			payload sql.NullString
+		)
+		if err = rows.Scan(&event.ID, &event.Tenant, &event.Operation, &payload); err != nil {
+			return nil, wrapError(ctx, err, "error scanning task event")
+		}
+		event.Task = &types.Task{}
+		if err = json.Unmarshal([]byte(payload.String), event.Task); err != nil {
+			return nil, errors.Wrapf(err, "error decoding task event %d", event.ID)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapError(ctx, err, "error retrieving task events")
+	}
+	return events, nil
+}
+
+// purgeTaskEvents removes events recorded before a time
+func (p *PersistenceManager) purgeTaskEvents(ctx context.Context, before time.Time) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := "delete from task_events where created < $1"
+	log.V(10).Info("Executing query",
+		"query", query,
+		"before", before)
+
+	if _, err := p.db.ExecContext(ctx, p.rebind(query), before.UTC()); err != nil {
+		return wrapError(ctx, err, "error purging task events")
+	}
+	return nil
+}
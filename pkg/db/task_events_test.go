@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// checkOutbox modifies tasks at a store and checks that events are recorded
+// at its outbox in order, and only for successful changes
+func checkOutbox(t *testing.T, s TaskStore, outbox taskEventOutbox) {
+	task, err := s.CreateTask(testContext, &types.Task{Name: "a", Status: types.StatusPending})
+	if err != nil {
+		t.Fatalf("creating task: %v", err)
+	}
+	task.Name = "b"
+	if task, err = s.UpdateOneTask(testContext, task); err != nil {
+		t.Fatalf("updating task: %v", err)
+	}
+	if _, err = s.UpdateOneTask(testContext, &types.Task{ID: task.ID, Version: 1}); err != ErrVersionConflict {
+		t.Fatalf("got error %v updating stale task, wanted version conflict", err)
+	}
+	if err = s.DeleteOneTask(testContext, task.ID, task.Version); err != nil {
+		t.Fatalf("deleting task: %v", err)
+	}
+
+	last, err := outbox.lastTaskEvent(context.Background())
+	if err != nil {
+		t.Fatalf("reading last event: %v", err)
+	}
+	if last != 3 {
+		t.Errorf("got last event %d, wanted 3", last)
+	}
+
+	events, err := outbox.taskEventsAfter(context.Background(), 1, 10)
+	if err != nil {
+		t.Fatalf("reading events: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, wanted 2", len(events))
+	}
+	for i, expected := range []types.TaskEvent{
+		{ID: 2, Operation: types.OperationUpdate, Tenant: "default", Task: &types.Task{Name: "b", Version: 2}},
+		{ID: 3, Operation: types.OperationDelete, Tenant: "default", Task: &types.Task{Name: "b", Version: 2}},
+	} {
+		e := events[i]
+		if e.ID != expected.ID || e.Operation != expected.Operation || e.Tenant != expected.Tenant ||
+			e.Task == nil || e.Task.Name != expected.Task.Name || e.Task.Version != expected.Task.Version {
+			t.Errorf("got event %+v with task %+v, wanted %+v with task %+v", e, e.Task, expected, expected.Task)
+		}
+	}
+
+	if err = outbox.purgeTaskEvents(context.Background(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("purging events: %v", err)
+	}
+	if events, err = outbox.taskEventsAfter(context.Background(), 0, 10); err != nil || len(events) != 0 {
+		t.Errorf("got events %+v and error %v after purging", events, err)
+	}
+}
+
+func TestMemoryOutbox(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+	checkOutbox(t, m, m)
+}
+
+func TestSQLiteOutbox(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+	checkOutbox(t, p, p)
+}
+
+// fakeOutbox serves a fixed list of events
+type fakeOutbox struct {
+	events []types.TaskEvent
+}
+
+func (f *fakeOutbox) lastTaskEvent(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (f *fakeOutbox) taskEventsAfter(ctx context.Context, ID, limit int) ([]types.TaskEvent, error) {
+	events := []types.TaskEvent{}
+	for _, e := range f.events {
+		if e.ID > ID && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (f *fakeOutbox) purgeTaskEvents(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func TestDispatchEvents(t *testing.T) {
+	var testData = []struct {
+		testName         string
+		events           []int
+		position         int
+		gapSince         time.Duration
+		expectedEvents   []int
+		expectedPosition int
+		expectedWaiting  bool
+	}{
+		{
+			testName:         "events in order",
+			events:           []int{1, 2, 3},
+			expectedEvents:   []int{1, 2, 3},
+			expectedPosition: 3,
+		},
+		{
+			testName:         "already dispatched events",
+			events:           []int{1, 2, 3},
+			position:         2,
+			expectedEvents:   []int{3},
+			expectedPosition: 3,
+		},
+		{
+			testName:         "wait for missing event",
+			events:           []int{1, 3},
+			expectedEvents:   []int{1},
+			expectedPosition: 1,
+			expectedWaiting:  true,
+		},
+		{
+			testName:         "dispatch past missing event after timeout",
+			events:           []int{1, 3, 4},
+			position:         1,
+			gapSince:         2 * dispatcherGapTimeout,
+			expectedEvents:   []int{3, 4},
+			expectedPosition: 4,
+		},
+	}
+
+	for _, td := range testData {
+		outbox := &fakeOutbox{}
+		for _, ID := range td.events {
+			outbox.events = append(outbox.events, types.TaskEvent{ID: ID})
+		}
+		d := newEventDispatcher(outbox)
+		d.events = make(chan types.TaskEvent, len(td.events))
+
+		var gapSince time.Time
+		if td.gapSince != 0 {
+			gapSince = time.Now().Add(-td.gapSince)
+		}
+		position, gapSince := d.dispatch(context.Background(), td.position, gapSince)
+		close(d.events)
+
+		delivered := []int{}
+		for e := range d.events {
+			delivered = append(delivered, e.ID)
+		}
+		if len(delivered) != len(td.expectedEvents) {
+			t.Errorf("%q: got events %v, wanted %v", td.testName, delivered, td.expectedEvents)
+		} else {
+			for i := range delivered {
+				if delivered[i] != td.expectedEvents[i] {
+					t.Errorf("%q: got events %v, wanted %v", td.testName, delivered, td.expectedEvents)
+					break
+				}
+			}
+		}
+		if position != td.expectedPosition {
+			t.Errorf("%q: got position %d, wanted %d", td.testName, position, td.expectedPosition)
+		}
+		if gapSince.IsZero() == td.expectedWaiting {
+			t.Errorf("%q: got waiting for missing event %t, wanted %t", td.testName, !gapSince.IsZero(), td.expectedWaiting)
+		}
+	}
+}
+
+func TestDispatchLateEvents(t *testing.T) {
+	outbox := &fakeOutbox{events: []types.TaskEvent{{ID: 1}, {ID: 3}, {ID: 5}}}
+	d := newEventDispatcher(outbox)
+	d.events = make(chan types.TaskEvent, 10)
+
+	position, _ := d.dispatch(context.Background(), 1, time.Now().Add(-2*dispatcherGapTimeout))
+	if position != 3 {
+		t.Fatalf("got position %d, wanted 3", position)
+	}
+	position, _ = d.dispatch(context.Background(), position, time.Now().Add(-2*dispatcherGapTimeout))
+	if position != 5 {
+		t.Fatalf("got position %d, wanted 5", position)
+	}
+
+	// event 2 commits late, event 4 was missing for too long
+	outbox.events = []types.TaskEvent{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}
+	d.missing[4] = time.Now().Add(-2 * dispatcherMissingTimeout)
+	position, _ = d.dispatch(context.Background(), position, time.Time{})
+	close(d.events)
+
+	delivered := []int{}
+	for e := range d.events {
+		delivered = append(delivered, e.ID)
+	}
+	expected := []int{3, 5, 2}
+	if fmt.Sprint(delivered) != fmt.Sprint(expected) {
+		t.Errorf("got events %v, wanted %v", delivered, expected)
+	}
+	if position != 5 {
+		t.Errorf("got position %d, wanted 5", position)
+	}
+	if len(d.missing) != 0 {
+		t.Errorf("got missing events %v, wanted none", d.missing)
+	}
+}
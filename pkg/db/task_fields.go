@@ -0,0 +1,85 @@
+package db
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// taskColumns are the task fields retrieved, in order
+var taskColumns = []string{"id", "name", "description", "category", "status", "duedate", "created", "version"}
+
+// selectedColumns returns the task columns to retrieve for the requested
+// fields, all of them if none is requested. The id and version identify
+// the task revision and are always retrieved, along with extra fields
+// such as those the query is ordered by
+func selectedColumns(fields []string, extra ...string) ([]string, error) {
+	if len(fields) == 0 {
+		return taskColumns, nil
+	}
+
+	requested := map[string]bool{"id": true, "version": true}
+	for _, f := range append(append([]string{}, fields...), extra...) {
+		if _, err := taskFieldPointer(&types.Task{}, f); err != nil {
+			return nil, err
+		}
+		requested[f] = true
+	}
+	columns := []string{}
+	for _, c := range taskColumns {
+		if requested[c] {
+			columns = append(columns, c)
+		}
+	}
+	return columns, nil
+}
+
+// queryColumns returns the task columns to retrieve for a query,
+// including the fields it is ordered by
+func queryColumns(q *clauses.Query) ([]string, error) {
+	order := make([]string, len(q.OrderBy))
+	for i, o := range q.OrderBy {
+		order[i] = o.Field
+	}
+	return selectedColumns(q.Fields, order...)
+}
+
+// taskFieldPointer returns a pointer to a task field by its database name
+func taskFieldPointer(t *types.Task, field string) (interface{}, error) {
+	switch field {
+	case "id":
+		return &t.ID, nil
+	case "name":
+		return &t.Name, nil
+	case "description":
+		return &t.Description, nil
+	case "category":
+		return &t.Category, nil
+	case "status":
+		return &t.Status, nil
+	case "duedate":
+		return &t.DueDate, nil
+	case "created":
+		return &t.Created, nil
+	case "version":
+		return &t.Version, nil
+	}
+	return nil, errors.Errorf("unknown task field %s", field)
+}
+
+// projectTask returns a task keeping only the columns fields
+func projectTask(t types.Task, columns []string) (types.Task, error) {
+	projected := types.Task{}
+	for _, c := range columns {
+		src, err := taskFieldPointer(&t, c)
+		if err != nil {
+			return types.Task{}, err
+		}
+		dst, _ := taskFieldPointer(&projected, c)
+		reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+	}
+	return projected, nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// ImportTasks creates tasks in bulk at a single transaction, either all
+// of them are created or none. Generated values are set at each task.
+// Postgres loads them through COPY, other drivers insert them one by one
+func (p *PersistenceManager) ImportTasks(ctx context.Context, items []*types.Task) error {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(ctx, err, "error starting ImportTasks transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	if p.driver == PostgresDriver {
+		err = p.copyTasks(ctx, tx, tenantID, items)
+	} else {
+		err = p.insertTasks(ctx, tx, tenantID, items)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return wrapError(ctx, err, "error committing ImportTasks transaction")
+	}
+	p.dispatcher.wake()
+	return nil
+}
+
+// insertTasks creates tasks one by one along with their revisions and events
+func (p *PersistenceManager) insertTasks(ctx context.Context, ex executor, tenantID string, items []*types.Task) error {
+	for _, item := range items {
+		var err error
+		if p.driver == SQLiteDriver {
+			err = p.createTaskNoReturning(ctx, ex, tenantID, item)
+		} else {
+			err = p.createTask(ctx, ex, tenantID, item)
+		}
+		if err != nil {
+			return err
+		}
+		if err = p.recordRevision(ctx, ex, tenantID, types.OperationCreate, item.ID, nil, item); err != nil {
+			return err
+		}
+		if err = p.recordTaskEvent(ctx, ex, tenantID, types.OperationCreate, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTasks loads tasks along with their revisions and events using COPY.
+// Since COPY doesn't return generated values, IDs are allocated
+// from the tasks sequence beforehand
+func (p *PersistenceManager) copyTasks(ctx context.Context, ex executor, tenantID string, items []*types.Task) error {
+	query := "select nextval(pg_get_serial_sequence('tasks', 'id')) from generate_series(1, $1)"
+	log.V(10).Info("Executing query",
+		"query", query,
+		"count", len(items))
+
+	rows, err := ex.QueryContext(ctx, query, len(items))
+	if err != nil {
+		return wrapError(ctx, err, "error allocating Task IDs")
+	}
+	ids := make([]int, 0, len(items))
+	for rows.Next() {
+		var ID int
+		if err = rows.Scan(&ID); err != nil {
+			_ = rows.Close()
+			return wrapError(ctx, err, "error scanning Task ID")
+		}
+		ids = append(ids, ID)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return wrapError(ctx, err, "error allocating Task IDs")
+	}
+	if len(ids) != len(items) {
+		return errors.Errorf("allocated %d Task IDs for %d tasks", len(ids), len(items))
+	}
+
+	now := time.Now().UTC()
+	tasks := make([][]interface{}, len(items))
+	revisions := make([][]interface{}, len(items))
+	events := make([][]interface{}, len(items))
+	for i, item := range items {
+		item.ID = ids[i]
+		item.Created = &now
+		item.Version = 1
+		item.Status = strings.ToLower(item.Status)
+
+		var deletedAt *time.Time
+		if item.Status == types.StatusDeleted {
+			deletedAt = &now
+		}
+		tasks[i] = []interface{}{item.ID, item.Name, item.Description, item.Category,
+			item.Status, item.DueDate, item.Created, item.Version, tenantID, deletedAt}
+
+		value, err := json.Marshal(item)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling Task")
+		}
+		revisions[i] = []interface{}{item.ID, types.OperationCreate, nil, string(value), tenantID}
+		events[i] = []interface{}{tenantID, types.OperationCreate, string(value)}
+	}
+
+	if err = copyIn(ctx, ex, "tasks", []string{"id", "name", "description", "category",
+		"status", "duedate", "created", "version", "tenant", "deleted_at"}, tasks); err != nil {
+		return err
+	}
+	if err = copyIn(ctx, ex, "task_revisions", []string{"task_id", "operation",
+		"old_value", "new_value", "tenant"}, revisions); err != nil {
+		return err
+	}
+	if err = copyIn(ctx, ex, "task_events", []string{"tenant", "operation", "task"}, events); err != nil {
+		return err
+	}
+
+	if _, err = ex.ExecContext(ctx, "select pg_notify($1, '')", taskEventsChannel); err != nil {
+		return wrapError(ctx, err, "error notifying task events")
+	}
+	return nil
+}
+
+// copyIn loads rows into a Postgres table columns using COPY
+func copyIn(ctx context.Context, ex executor, table string, columns []string, rows [][]interface{}) error {
+	query := pq.CopyIn(table, columns...)
+	log.V(10).Info("Executing query",
+		"query", query,
+		"rows", len(rows))
+
+	stmt, err := ex.PrepareContext(ctx, query)
+	if err != nil {
+		return wrapError(ctx, err, "error preparing COPY statement")
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			return wrapError(ctx, err, "error copying rows to "+table)
+		}
+	}
+	// flush buffered rows
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return wrapError(ctx, err, "error copying rows to "+table)
+	}
+	return nil
+}
+
+// ImportTasks creates tasks in bulk, either all of them are created or none.
+// Generated values are set at each task
+func (m *MemoryPersistenceManager) ImportTasks(ctx context.Context, items []*types.Task) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "error importing Tasks")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, item := range items {
+		m.createTask(tenantID, item)
+	}
+	if len(items) != 0 {
+		m.dispatcher.wake()
+	}
+	return nil
+}
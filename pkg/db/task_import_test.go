@@ -0,0 +1,93 @@
+package db
+
+import (
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// importTestTasks returns tasks to be imported
+func importTestTasks() []*types.Task {
+	return []*types.Task{
+		{Name: "a", Category: "home", Status: "Pending"},
+		{Name: "b", Category: "work", Status: types.StatusDeleted},
+	}
+}
+
+// checkImportTasks imports tasks at a store and checks they are listed
+func checkImportTasks(t *testing.T, s TaskStore) {
+	items := importTestTasks()
+	if err := s.ImportTasks(testContext, items); err != nil {
+		t.Fatalf("importing tasks: %v", err)
+	}
+	for _, item := range items {
+		if item.ID == 0 || item.Created == nil || item.Version != 1 {
+			t.Errorf("missing generated values at %+v", item)
+		}
+	}
+
+	tasks, err := s.SelectTasks(testContext, &clauses.Query{})
+	if err != nil {
+		t.Fatalf("selecting tasks: %v", err)
+	}
+	if len(tasks) != 2 || tasks[0].Status != types.StatusPending || tasks[1].Name != "b" {
+		t.Errorf("unexpected tasks %+v", tasks)
+	}
+
+	revisions, err := s.TaskHistory(testContext, items[0].ID, &clauses.Query{})
+	if err != nil {
+		t.Fatalf("getting history: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Operation != types.OperationCreate {
+		t.Errorf("got revisions %+v, wanted a create", revisions)
+	}
+}
+
+func TestMemoryImportTasks(t *testing.T) {
+	checkImportTasks(t, NewMemoryPersistenceManager())
+}
+
+func TestSQLiteImportTasks(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	checkImportTasks(t, p)
+}
+
+func TestPostgresImportTasks(t *testing.T) {
+	fakeDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("opening mock database: %v", err)
+	}
+	defer fakeDB.Close()
+	p := NewTODOPersistenceManager(fakeDB)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^select nextval\(pg_get_serial_sequence\('tasks', 'id'\)\) from generate_series\(1, \$1\)$`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(11).AddRow(12))
+	for _, table := range []string{"tasks", "task_revisions", "task_events"} {
+		copyStmt := mock.ExpectPrepare(`^COPY "` + table + `" \((.*)\) FROM STDIN$`)
+		for i := 0; i < 3; i++ {
+			copyStmt.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+	mock.ExpectExec(`^select pg_notify\(\$1, ''\)$`).
+		WithArgs("task_events").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	items := importTestTasks()
+	if err = p.ImportTasks(testContext, items); err != nil {
+		t.Fatalf("importing tasks: %v", err)
+	}
+	if items[0].ID != 11 || items[1].ID != 12 || items[0].Status != types.StatusPending {
+		t.Errorf("unexpected imported tasks %+v, %+v", items[0], items[1])
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("database expectations: %v", err)
+	}
+}
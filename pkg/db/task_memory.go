@@ -0,0 +1,766 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// MemoryPersistenceManager exposes entities persistence methods
+// for TODO list keeping them in memory.
+// Data is lost when the process ends, it is meant for local runs and CI
+type MemoryPersistenceManager struct {
+	mutex     sync.RWMutex
+	lastID    int
+	tasks     map[int]*types.Task
+	tenants   map[int]string
+	deletedAt map[int]time.Time
+	// status of deleted tasks before deletion
+	previousStatus map[int]string
+	revisions      []memoryRevision
+	events         []memoryEvent
+	lastEvent      int
+
+	dispatcher *eventDispatcher
+}
+
+// memoryRevision is a task revision along with the task tenant
+type memoryRevision struct {
+	tenant   string
+	revision types.TaskRevision
+}
+
+// memoryEvent is a task event along with the time it was recorded
+type memoryEvent struct {
+	created time.Time
+	event   types.TaskEvent
+}
+
+var _ TaskStore = &MemoryPersistenceManager{}
+
+// NewMemoryPersistenceManager returns an empty in memory persistence manager
+func NewMemoryPersistenceManager() *MemoryPersistenceManager {
+	m := &MemoryPersistenceManager{
+		tasks:          make(map[int]*types.Task),
+		tenants:        make(map[int]string),
+		deletedAt:      make(map[int]time.Time),
+		previousStatus: make(map[int]string),
+	}
+	m.dispatcher = newEventDispatcher(m)
+	return m
+}
+
+// SelectTasks filters, sorts and paginates stored tasks
+func (m *MemoryPersistenceManager) SelectTasks(ctx context.Context, q *clauses.Query) ([]types.Task, error) {
+	log.V(10).Info("Executing in memory query", "query", q)
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error retrieving Tasks")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	items := []types.Task{}
+	for _, t := range m.tasks {
+		if m.tenants[t.ID] != tenantID {
+			continue
+		}
+		match, err := matchQuery(t, q)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			items = append(items, copyTask(t))
+		}
+	}
+
+	// default to id ordering, then apply requested ordering
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	for _, o := range q.OrderBy {
+		if _, err := taskFieldValue(&types.Task{}, o.Field); err != nil {
+			return nil, errors.Wrap(err, "error sorting Tasks")
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, o := range q.OrderBy {
+			a, _ := taskFieldValue(&items[i], o.Field)
+			b, _ := taskFieldValue(&items[j], o.Field)
+			if c := compareOrdered(a, b, o); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	// searches without explicit order are sorted by relevance,
+	// the tasks matching search terms more times first
+	if len(q.Search) != 0 && len(q.OrderBy) == 0 {
+		sort.SliceStable(items, func(i, j int) bool {
+			return searchMatches(&items[i], q.Search) > searchMatches(&items[j], q.Search)
+		})
+	}
+
+	start, end := paginate(q, len(items))
+	items = items[start:end]
+	if len(q.Fields) != 0 {
+		columns, err := queryColumns(q)
+		if err != nil {
+			return nil, errors.Wrap(err, "error retrieving Tasks")
+		}
+		for i := range items {
+			if items[i], err = projectTask(items[i], columns); err != nil {
+				return nil, errors.Wrap(err, "error retrieving Tasks")
+			}
+		}
+	}
+	return items, nil
+}
+
+// CountTasks returns the number of stored tasks matching a query,
+// ignoring pagination
+func (m *MemoryPersistenceManager) CountTasks(ctx context.Context, q *clauses.Query) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "error counting Tasks")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	count := 0
+	for _, t := range m.tasks {
+		if m.tenants[t.ID] != tenantID {
+			continue
+		}
+		match, err := matchQuery(t, q)
+		if err != nil {
+			return 0, err
+		}
+		if match {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetTask from memory
+// If object by ID doesn't exists, nil is returned
+func (m *MemoryPersistenceManager) GetTask(ctx context.Context, ID int, fields ...string) (*types.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error retrieving Task")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := selectedColumns(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Task")
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	t, ok := m.tasks[ID]
+	if !ok || m.tenants[ID] != tenantID {
+		return nil, nil
+	}
+	item, err := projectTask(copyTask(t), columns)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving Task")
+	}
+	return &item, nil
+}
+
+// CreateTask in memory
+func (m *MemoryPersistenceManager) CreateTask(ctx context.Context, item *types.Task) (*types.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error creating Task")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.createTask(tenantID, item)
+	m.dispatcher.wake()
+	return item, nil
+}
+
+// createTask stores a tenant task setting its generated values.
+// Caller must hold the write lock
+func (m *MemoryPersistenceManager) createTask(tenantID string, item *types.Task) {
+	m.lastID++
+	now := time.Now().UTC()
+	item.ID = m.lastID
+	item.Created = &now
+	item.Version = 1
+	item.Status = strings.ToLower(item.Status)
+
+	stored := copyTask(item)
+	m.tasks[item.ID] = &stored
+	m.tenants[item.ID] = tenantID
+	m.markDeleted(nil, &stored)
+	m.recordRevision(tenantID, types.OperationCreate, item.ID, nil, &stored)
+	m.recordTaskEvent(tenantID, types.OperationCreate, &stored)
+}
+
+// UpdateOneTask object in memory.
+// The update only succeeds if the stored version matches the item version,
+// otherwise ErrVersionConflict is returned
+func (m *MemoryPersistenceManager) UpdateOneTask(ctx context.Context, item *types.Task) (*types.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error updating Task")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tasks[item.ID]
+	if !ok || m.tenants[item.ID] != tenantID || t.Version != item.Version {
+		return nil, ErrVersionConflict
+	}
+	item.Status = strings.ToLower(item.Status)
+	item.Version++
+
+	stored := copyTask(item)
+	stored.Created = t.Created
+	m.tasks[item.ID] = &stored
+	m.markDeleted(t, &stored)
+	m.recordRevision(tenantID, types.OperationUpdate, item.ID, t, &stored)
+	m.recordTaskEvent(tenantID, types.OperationUpdate, &stored)
+	m.dispatcher.wake()
+	return item, nil
+}
+
+// DeleteOneTask object from memory.
+// The delete only succeeds if the stored version matches,
+// otherwise ErrVersionConflict is returned
+func (m *MemoryPersistenceManager) DeleteOneTask(ctx context.Context, ID, version int) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "error deleting Task")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tasks[ID]
+	if !ok || m.tenants[ID] != tenantID || t.Version != version {
+		return ErrVersionConflict
+	}
+	delete(m.tasks, ID)
+	delete(m.tenants, ID)
+	delete(m.deletedAt, ID)
+	delete(m.previousStatus, ID)
+	m.recordRevision(tenantID, types.OperationDelete, ID, t, nil)
+	m.recordTaskEvent(tenantID, types.OperationDelete, t)
+	m.dispatcher.wake()
+	return nil
+}
+
+// RestoreTask puts a logically deleted task back to the status it had
+// before being deleted, pending if it is unknown.
+// The restore only succeeds if the stored version matches,
+// otherwise ErrVersionConflict is returned
+func (m *MemoryPersistenceManager) RestoreTask(ctx context.Context, ID, version int) (*types.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error restoring Task")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tasks[ID]
+	if !ok || m.tenants[ID] != tenantID || t.Version != version {
+		return nil, ErrVersionConflict
+	}
+	if t.Status != types.StatusDeleted {
+		return nil, ErrNotDeleted
+	}
+
+	stored := copyTask(t)
+	stored.Status = types.StatusPending
+	if previous, ok := m.previousStatus[ID]; ok {
+		stored.Status = previous
+	}
+	stored.Version++
+	m.tasks[ID] = &stored
+	m.markDeleted(t, &stored)
+	m.recordRevision(tenantID, types.OperationUpdate, ID, t, &stored)
+	m.recordTaskEvent(tenantID, types.OperationUpdate, &stored)
+	m.dispatcher.wake()
+
+	item := copyTask(&stored)
+	return &item, nil
+}
+
+// TaskHistory returns the recorded revisions for a task, oldest first
+func (m *MemoryPersistenceManager) TaskHistory(ctx context.Context, ID int, q *clauses.Query) ([]types.TaskRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error retrieving Task revisions")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	items := []types.TaskRevision{}
+	for _, r := range m.revisions {
+		if r.revision.TaskID == ID && r.tenant == tenantID {
+			items = append(items, r.revision)
+		}
+	}
+
+	start, end := paginate(q, len(items))
+	return items[start:end], nil
+}
+
+// recordRevision stores a tenant task change, tasks must not be modified afterwards.
+// Caller must hold the write lock
+func (m *MemoryPersistenceManager) recordRevision(tenantID, operation string, ID int, old, new *types.Task) {
+	now := time.Now().UTC()
+	m.revisions = append(m.revisions, memoryRevision{
+		tenant: tenantID,
+		revision: types.TaskRevision{
+			ID:        len(m.revisions) + 1,
+			TaskID:    ID,
+			Operation: operation,
+			Old:       old,
+			New:       new,
+			Created:   &now,
+		},
+	})
+}
+
+// markDeleted keeps the time a task was logically deleted and its status
+// before, forgetting them when the task isn't deleted anymore.
+// Caller must hold the write lock
+func (m *MemoryPersistenceManager) markDeleted(old, new *types.Task) {
+	if new.Status != types.StatusDeleted {
+		delete(m.deletedAt, new.ID)
+		delete(m.previousStatus, new.ID)
+		return
+	}
+	if old != nil && old.Status != types.StatusDeleted {
+		m.previousStatus[new.ID] = old.Status
+	}
+	if _, ok := m.deletedAt[new.ID]; !ok {
+		m.deletedAt[new.ID] = time.Now()
+	}
+}
+
+// recordTaskEvent stores a tenant task change at the events outbox,
+// the task must not be modified afterwards.
+// Caller must hold the write lock
+func (m *MemoryPersistenceManager) recordTaskEvent(tenantID, operation string, task *types.Task) {
+	m.lastEvent++
+	m.events = append(m.events, memoryEvent{
+		created: time.Now(),
+		event: types.TaskEvent{
+			ID:        m.lastEvent,
+			Operation: operation,
+			Tenant:    tenantID,
+			Task:      task,
+		},
+	})
+}
+
+// TaskEvents returns the channel where task changes are published,
+// starting the events dispatcher
+func (m *MemoryPersistenceManager) TaskEvents() <-chan types.TaskEvent {
+	return m.dispatcher.start()
+}
+
+// lastTaskEvent returns the ID of the last recorded event, 0 if none
+func (m *MemoryPersistenceManager) lastTaskEvent(ctx context.Context) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.lastEvent, nil
+}
+
+// taskEventsAfter returns up to limit events recorded after ID, in order
+func (m *MemoryPersistenceManager) taskEventsAfter(ctx context.Context, ID, limit int) ([]types.TaskEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	start := sort.Search(len(m.events), func(i int) bool { return m.events[i].event.ID > ID })
+	events := []types.TaskEvent{}
+	for _, e := range m.events[start:] {
+		if len(events) == limit {
+			break
+		}
+		events = append(events, e.event)
+	}
+	return events, nil
+}
+
+// purgeTaskEvents removes events recorded before a time
+func (m *MemoryPersistenceManager) purgeTaskEvents(ctx context.Context, before time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := sort.Search(len(m.events), func(i int) bool { return !m.events[i].created.Before(before) })
+	m.events = append([]memoryEvent(nil), m.events[n:]...)
+	return nil
+}
+
+// paginate returns the slice bounds for a query page out of count items
+func paginate(q *clauses.Query, count int) (int, int) {
+	if q.PageSize <= 0 {
+		return 0, count
+	}
+	start := (q.Page - 1) * q.PageSize
+	if start < 0 || start >= count {
+		return 0, 0
+	}
+	end := start + q.PageSize
+	if end > count {
+		end = count
+	}
+	return start, end
+}
+
+// copyTask returns a Task that doesn't share references with the original
+func copyTask(t *types.Task) types.Task {
+	c := *t
+	if t.DueDate != nil {
+		d := *t.DueDate
+		c.DueDate = &d
+	}
+	if t.Created != nil {
+		d := *t.Created
+		c.Created = &d
+	}
+	return c
+}
+
+// taskFieldValue returns the value of a task field by its database name
+func taskFieldValue(t *types.Task, field string) (interface{}, error) {
+	switch field {
+	case "id":
+		return t.ID, nil
+	case "name":
+		return t.Name, nil
+	case "description":
+		return t.Description, nil
+	case "category":
+		return t.Category, nil
+	case "status":
+		return t.Status, nil
+	case "duedate":
+		return t.DueDate, nil
+	case "created":
+		return t.Created, nil
+	case "version":
+		return t.Version, nil
+	}
+	return nil, errors.Errorf("unknown task field %s", field)
+}
+
+// matchQuery checks a task against query filters, filter expression,
+// cursor and search terms
+func matchQuery(t *types.Task, q *clauses.Query) (bool, error) {
+	match, err := matchTask(t, q.Filters)
+	if err == nil && match && q.Expression != nil {
+		match, err = matchExpression(t, q.Expression)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "error filtering Tasks")
+	}
+	if match {
+		match, err = afterCursor(t, q)
+		if err != nil {
+			return false, errors.Wrap(err, "error applying cursor")
+		}
+	}
+	return match && matchSearch(t, q.Search), nil
+}
+
+// matchTask checks a task against all filters
+func matchTask(t *types.Task, filters []clauses.FilterItem) (bool, error) {
+	for _, f := range filters {
+		fv, err := taskFieldValue(t, f.Field)
+		if err != nil {
+			return false, err
+		}
+		tv, isTime := fv.(*time.Time)
+		isNil := isTime && tv == nil
+		switch f.Comparison {
+		case "is null", "is not null":
+			if isNil != (f.Comparison == "is null") {
+				return false, nil
+			}
+			continue
+		}
+		// a nil field value never matches, as SQL null wouldn't
+		if isNil {
+			return false, nil
+		}
+
+		var match bool
+		switch f.Comparison {
+		case "in":
+			list, ok := f.Value.([]interface{})
+			if !ok {
+				return false, errors.Errorf("filter on %s needs a list of values", f.Field)
+			}
+			for _, lv := range list {
+				v, err := convertValue(fv, lv)
+				if err != nil {
+					return false, errors.Wrapf(err, "field %s", f.Field)
+				}
+				if compareValues(fv, v) == 0 {
+					match = true
+					break
+				}
+			}
+		case "like":
+			pattern, ok := f.Value.(string)
+			if !ok {
+				return false, errors.Errorf("filter on %s needs a pattern", f.Field)
+			}
+			match, err = matchLike(fmt.Sprint(fv), pattern)
+			if err != nil {
+				return false, errors.Wrapf(err, "field %s", f.Field)
+			}
+		default:
+			v, err := convertValue(fv, f.Value)
+			if err != nil {
+				return false, errors.Wrapf(err, "field %s", f.Field)
+			}
+			c := compareValues(fv, v)
+			switch f.Comparison {
+			case "=":
+				match = c == 0
+			case "<>":
+				match = c != 0
+			case ">":
+				match = c > 0
+			case ">=":
+				match = c >= 0
+			case "<":
+				match = c < 0
+			case "<=":
+				match = c <= 0
+			default:
+				return false, fmt.Errorf("%s is not one of the supported compare clauses", f.Comparison)
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchExpression checks a task against a filter expression
+func matchExpression(t *types.Task, e *clauses.FilterExpression) (bool, error) {
+	if e.Filter != nil {
+		return matchTask(t, []clauses.FilterItem{*e.Filter})
+	}
+	if e.Logic != clauses.ExpressionAnd && e.Logic != clauses.ExpressionOr {
+		return false, errors.Errorf("%s is not a supported filter expression logic", e.Logic)
+	}
+	for _, o := range e.Operands {
+		match, err := matchExpression(t, o)
+		if err != nil {
+			return false, err
+		}
+		// and stops at the first mismatch, or at the first match
+		if match == (e.Logic == clauses.ExpressionOr) {
+			return match, nil
+		}
+	}
+	return e.Logic == clauses.ExpressionAnd, nil
+}
+
+// matchLike checks a value against a like pattern, where % matches any
+// characters, _ matches one character and \ escapes the next one
+func matchLike(value, pattern string) (bool, error) {
+	expr := strings.Builder{}
+	expr.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			expr.WriteString(".*")
+		case r == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile("(?s)" + expr.String())
+	if err != nil {
+		return false, errors.Wrap(err, "error parsing like pattern")
+	}
+	return re.MatchString(value), nil
+}
+
+// convertValue converts a filter value to the type of the field
+// it will be compared to
+func convertValue(field, value interface{}) (interface{}, error) {
+	if t, ok := value.(time.Time); ok {
+		return &t, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	switch field.(type) {
+	case int:
+		return strconv.Atoi(s)
+	case *time.Time:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+	return s, nil
+}
+
+// compareValues returns -1, 0 or 1 when a is lower, equal or greater than b.
+// Both values must be of the same type, nil times are sorted last
+func compareValues(a, b interface{}) int {
+	switch av := a.(type) {
+	case int:
+		bv := b.(int)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(av, b.(string))
+	case *time.Time:
+		bv := b.(*time.Time)
+		switch {
+		case av == nil && bv == nil:
+			return 0
+		case av == nil:
+			return 1
+		case bv == nil:
+			return -1
+		case av.Before(*bv):
+			return -1
+		case av.After(*bv):
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+// afterCursor checks if a task is sorted after the query cursor,
+// always true when there is no cursor
+func afterCursor(t *types.Task, q *clauses.Query) (bool, error) {
+	if q.Cursor == nil {
+		return true, nil
+	}
+	for i, o := range q.OrderBy {
+		fv, err := taskFieldValue(t, o.Field)
+		if err != nil {
+			return false, err
+		}
+		var v interface{}
+		if cv := q.Cursor.Values[i]; cv != nil {
+			v, err = convertValue(fv, *cv)
+			if err != nil {
+				return false, errors.Wrapf(err, "field %s", o.Field)
+			}
+		}
+		if c := compareOrdered(fv, v, o); c != 0 {
+			return c > 0, nil
+		}
+	}
+	return false, nil
+}
+
+// compareOrdered returns -1, 0 or 1 when a is sorted before, along
+// or after b for an order item. Nil values are nulls, placed as the order
+// item requests
+func compareOrdered(a, b interface{}, o clauses.OrderItem) int {
+	aNull, bNull := isNullValue(a), isNullValue(b)
+	switch {
+	case aNull && bNull:
+		return 0
+	case aNull || bNull:
+		if aNull == o.NullsFirst() {
+			return -1
+		}
+		return 1
+	}
+	c := compareValues(a, b)
+	if o.Sort == "desc" {
+		return -c
+	}
+	return c
+}
+
+// isNullValue checks if a task field value is null
+func isNullValue(v interface{}) bool {
+	t, ok := v.(*time.Time)
+	return v == nil || (ok && t == nil)
+}
+
+// matchSearch checks that all search terms are contained
+// at the task name or description, ignoring case
+func matchSearch(t *types.Task, search string) bool {
+	document := strings.ToLower(t.Name + " " + t.Description)
+	for _, term := range strings.Fields(strings.ToLower(search)) {
+		if !strings.Contains(document, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchMatches counts the times search terms are found
+// at the task name or description, ignoring case
+func searchMatches(t *types.Task, search string) int {
+	document := strings.ToLower(t.Name + " " + t.Description)
+	matches := 0
+	for _, term := range strings.Fields(strings.ToLower(search)) {
+		matches += strings.Count(document, term)
+	}
+	return matches
+}
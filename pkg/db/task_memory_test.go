@@ -0,0 +1,525 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/log/dummy"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// testContext is used for all store operations, unless
+// tenant isolation is tested
+var testContext = tenant.NewContext(context.Background(), tenant.Default)
+
+// testAllowedOrder are the task fields listings can be sorted by
+var testAllowedOrder = clauses.MustAllowlistsFromType(types.Task{}).Order
+
+func TestMain(m *testing.M) {
+	// global logger must be initialized
+	log.SetDefaultLogger(&dummy.Logger{})
+	os.Exit(m.Run())
+}
+
+func TestMemorySelectTasks(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+	for _, task := range []types.Task{
+		{Name: "b", Description: "buy milk", Category: "home", Status: types.StatusPending},
+		{Name: "a", Category: "work", Status: types.StatusStarted},
+		{Name: "c", Category: "home", Status: types.StatusFinished},
+		{Name: "d", Description: "Milk delivery", Category: "home", Status: types.StatusPending},
+	} {
+		task := task
+		if _, err := m.CreateTask(testContext, &task); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer", Operators: []string{"eq", "gt", "lte", "in"}},
+		{URLField: "name", DBField: "name", Type: "string", Operators: []string{"eq", "like"}},
+		{URLField: "category", DBField: "category", Type: "string", Operators: []string{"eq", "ne"}},
+		{URLField: "status", DBField: "status", Type: "string", Operators: []string{"eq", "in"}},
+	}
+
+	var selectTests = []struct {
+		values      map[string]string
+		expectedIDs []int
+	}{
+		{map[string]string{}, []int{1, 2, 3, 4}},
+		{map[string]string{"category": "home"}, []int{1, 3, 4}},
+		{map[string]string{"category": "home", "status": "pending"}, []int{1, 4}},
+		{map[string]string{"id": "2"}, []int{2}},
+		{map[string]string{"order": "name"}, []int{2, 1, 3, 4}},
+		{map[string]string{"order": "name:desc"}, []int{4, 3, 1, 2}},
+		{map[string]string{"page": "2", "page_size": "3"}, []int{4}},
+		{map[string]string{"page": "3", "page_size": "3"}, []int{}},
+		{map[string]string{"page_size": "0", "order": "id:desc"}, []int{4, 3, 2, 1}},
+		{map[string]string{"q": "milk"}, []int{1, 4}},
+		{map[string]string{"q": "buy MILK", "category": "home"}, []int{1}},
+		{map[string]string{"id[gt]": "1", "id[lte]": "3"}, []int{2, 3}},
+		{map[string]string{"id[in]": "1,4,7"}, []int{1, 4}},
+		{map[string]string{"status[in]": "pending,started"}, []int{1, 2, 4}},
+		{map[string]string{"category[ne]": "home"}, []int{2}},
+		{map[string]string{"name[like]": "*"}, []int{1, 2, 3, 4}},
+		{map[string]string{"name[like]": "c*"}, []int{3}},
+	}
+
+	for _, st := range selectTests {
+		t.Run(fmt.Sprintf("select %+v", st.values),
+			func(t *testing.T) {
+				q, err := clauses.BuildQueryClauseFromRequest(st.values, allowedWhere, testAllowedOrder)
+				if err != nil {
+					t.Fatalf("building query: %v", err)
+				}
+				tasks, err := m.SelectTasks(testContext, q)
+				if err != nil {
+					t.Fatalf("selecting tasks: %v", err)
+				}
+				ids := []int{}
+				for _, task := range tasks {
+					ids = append(ids, task.ID)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(st.expectedIDs) {
+					t.Errorf("got %v, wanted %v", ids, st.expectedIDs)
+				}
+			})
+	}
+
+	q, err := clauses.BuildQueryClauseFromRequest(
+		map[string]string{"category": "home", "page_size": "1"}, allowedWhere, testAllowedOrder)
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	count, err := m.CountTasks(testContext, q)
+	if err != nil {
+		t.Fatalf("counting tasks: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("got count %d, wanted 3", count)
+	}
+}
+
+func TestMemoryCursorPagination(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+	for _, name := range []string{"b", "a", "b", "c", "a"} {
+		if _, err := m.CreateTask(testContext, &types.Task{Name: name, Category: "home", Status: types.StatusPending}); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	ids := selectPages(t, m, map[string]string{"order": "name:desc", "page_size": "2"})
+	if fmt.Sprint(ids) != fmt.Sprint([]int{4, 1, 3, 2, 5}) {
+		t.Errorf("got %v, wanted %v", ids, []int{4, 1, 3, 2, 5})
+	}
+}
+
+// selectPages lists all tasks following cursors, returning their IDs
+func selectPages(t *testing.T, s TaskStore, values map[string]string) []int {
+	ids := []int{}
+	for pages := 0; pages < 10; pages++ {
+		q, err := clauses.BuildQueryClauseFromRequest(values, nil, testAllowedOrder)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		tasks, err := s.SelectTasks(testContext, q)
+		if err != nil {
+			t.Fatalf("selecting tasks: %v", err)
+		}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if len(tasks) < q.PageSize {
+			break
+		}
+		cursor, err := TaskCursor(q.OrderBy, &tasks[len(tasks)-1])
+		if err != nil {
+			t.Fatalf("building cursor: %v", err)
+		}
+		values[clauses.CursorQuery] = cursor
+	}
+	return ids
+}
+
+func TestMemoryTaskLifecycle(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+
+	task, err := m.CreateTask(testContext, &types.Task{Name: "task", Status: "Pending"})
+	if err != nil {
+		t.Fatalf("creating task: %v", err)
+	}
+	if task.ID != 1 || task.Created == nil || task.Status != types.StatusPending || task.Version != 1 {
+		t.Errorf("unexpected created task %+v", task)
+	}
+
+	task.Name = "renamed"
+	if _, err = m.UpdateOneTask(testContext, task); err != nil {
+		t.Fatalf("updating task: %v", err)
+	}
+	got, err := m.GetTask(testContext, task.ID)
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if got == nil || got.Name != "renamed" || got.Version != 2 {
+		t.Errorf("got %+v, wanted renamed task", got)
+	}
+
+	if err = m.DeleteOneTask(testContext, task.ID, 1); err != ErrVersionConflict {
+		t.Errorf("got %v deleting a stale task, wanted %v", err, ErrVersionConflict)
+	}
+
+	if err = m.DeleteOneTask(testContext, task.ID, task.Version); err != nil {
+		t.Fatalf("deleting task: %v", err)
+	}
+	got, err = m.GetTask(testContext, task.ID)
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if got != nil {
+		t.Errorf("got %+v, wanted deleted task", got)
+	}
+}
+
+func TestMemoryTenantIsolation(t *testing.T) {
+	checkTenantIsolation(t, NewMemoryPersistenceManager())
+}
+
+// checkTenantIsolation makes sure tasks are not visible nor
+// modifiable from other tenants
+func checkTenantIsolation(t *testing.T, s TaskStore) {
+	teamA := tenant.NewContext(context.Background(), "team-a")
+	teamB := tenant.NewContext(context.Background(), "team-b")
+
+	task, err := s.CreateTask(teamA, &types.Task{Name: "a", Category: "home", Status: types.StatusPending})
+	if err != nil {
+		t.Fatalf("creating task: %v", err)
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer"},
+		{URLField: "name", DBField: "name", Type: "string"},
+	}
+	for _, values := range []map[string]string{
+		{"id": fmt.Sprint(task.ID)},
+		{"filter": fmt.Sprintf("id==%d,name==a", task.ID)},
+	} {
+		q, err := clauses.BuildQueryClauseFromRequest(values, allowedWhere, nil)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		tasks, err := s.SelectTasks(teamB, q)
+		if err != nil || len(tasks) != 0 {
+			t.Errorf("got %+v, %v selecting other tenant tasks with %v", tasks, err, values)
+		}
+		count, err := s.CountTasks(teamB, q)
+		if err != nil || count != 0 {
+			t.Errorf("got %d, %v counting other tenant tasks with %v", count, err, values)
+		}
+	}
+	got, err := s.GetTask(teamB, task.ID)
+	if err != nil || got != nil {
+		t.Errorf("got %+v, %v getting other tenant task", got, err)
+	}
+	if _, err = s.UpdateOneTask(teamB, task); err != ErrVersionConflict {
+		t.Errorf("got %v updating other tenant task, wanted %v", err, ErrVersionConflict)
+	}
+	if err = s.DeleteOneTask(teamB, task.ID, task.Version); err != ErrVersionConflict {
+		t.Errorf("got %v deleting other tenant task, wanted %v", err, ErrVersionConflict)
+	}
+	revisions, err := s.TaskHistory(teamB, task.ID, &clauses.Query{})
+	if err != nil || len(revisions) != 0 {
+		t.Errorf("got %+v, %v getting other tenant task history", revisions, err)
+	}
+	if _, err = s.GetTask(context.Background(), task.ID); err != ErrMissingTenant {
+		t.Errorf("got %v getting a task without tenant, wanted %v", err, ErrMissingTenant)
+	}
+
+	got, err = s.GetTask(teamA, task.ID)
+	if err != nil || got == nil || got.Version != 1 {
+		t.Errorf("got %+v, %v getting own task", got, err)
+	}
+}
+
+func TestMemoryTenantOrFilter(t *testing.T) {
+	checkTenantOrFilter(t, NewMemoryPersistenceManager())
+}
+
+// checkTenantOrFilter lists tasks of two tenants with an or filter
+// matching tasks of both, expecting only the caller tenant tasks
+func checkTenantOrFilter(t *testing.T, s TaskStore) {
+	teamA := tenant.NewContext(context.Background(), "team-a")
+	teamB := tenant.NewContext(context.Background(), "team-b")
+	for _, ctx := range []context.Context{teamA, teamB, teamA, teamB} {
+		for _, name := range []string{"a", "b"} {
+			if _, err := s.CreateTask(ctx, &types.Task{Name: name, Status: types.StatusPending}); err != nil {
+				t.Fatalf("creating task: %v", err)
+			}
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{{URLField: "name", DBField: "name", Type: "string"}}
+	q, err := clauses.BuildQueryClauseFromRequest(
+		map[string]string{"filter": "name==a,name==b", "order": "id"}, allowedWhere, testAllowedOrder)
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	for ctx, expectedIDs := range map[context.Context][]int{teamA: {1, 2, 5, 6}, teamB: {3, 4, 7, 8}} {
+		tasks, err := s.SelectTasks(ctx, q)
+		if err != nil {
+			t.Fatalf("selecting tasks: %v", err)
+		}
+		ids := []int{}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(expectedIDs) {
+			t.Errorf("got %v, wanted %v", ids, expectedIDs)
+		}
+		count, err := s.CountTasks(ctx, q)
+		if err != nil || count != len(expectedIDs) {
+			t.Errorf("got %d, %v counting tasks, wanted %d", count, err, len(expectedIDs))
+		}
+	}
+}
+
+func TestMemoryRestoreTask(t *testing.T) {
+	checkRestoreTask(t, NewMemoryPersistenceManager())
+}
+
+// checkRestoreTask deletes a task logically twice and checks that
+// restoring it brings back the status it had before the first delete
+func checkRestoreTask(t *testing.T, s TaskStore) {
+	task, err := s.CreateTask(testContext, &types.Task{Name: "a", Status: types.StatusStarted})
+	if err != nil {
+		t.Fatalf("creating task: %v", err)
+	}
+	if _, err = s.RestoreTask(testContext, task.ID, task.Version); err != ErrNotDeleted {
+		t.Errorf("got error %v restoring a task not deleted, wanted %v", err, ErrNotDeleted)
+	}
+
+	for i := 0; i < 2; i++ {
+		task.Status = types.StatusDeleted
+		if task, err = s.UpdateOneTask(testContext, task); err != nil {
+			t.Fatalf("deleting task: %v", err)
+		}
+	}
+	if _, err = s.RestoreTask(testContext, task.ID, task.Version-1); err != ErrVersionConflict {
+		t.Errorf("got error %v restoring a stale task, wanted %v", err, ErrVersionConflict)
+	}
+
+	restored, err := s.RestoreTask(testContext, task.ID, task.Version)
+	if err != nil {
+		t.Fatalf("restoring task: %v", err)
+	}
+	if restored.Status != types.StatusStarted || restored.Version != task.Version+1 {
+		t.Errorf("got restored task %+v, wanted started at version %d", restored, task.Version+1)
+	}
+
+	got, err := s.GetTask(testContext, task.ID)
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if got == nil || got.Status != types.StatusStarted {
+		t.Errorf("got stored task %+v, wanted started", got)
+	}
+}
+
+func TestMemoryDateFilters(t *testing.T) {
+	checkDateFilters(t, NewMemoryPersistenceManager())
+}
+
+// checkDateFilters lists tasks by due and created date ranges,
+// and by having a due date
+func checkDateFilters(t *testing.T, s TaskStore) {
+	past := time.Now().UTC().Add(-48 * time.Hour)
+	future := time.Now().UTC().Add(72 * time.Hour)
+	for _, due := range []*time.Time{&past, &future, nil} {
+		if _, err := s.CreateTask(testContext, &types.Task{Name: "a", Status: types.StatusPending, DueDate: due}); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "due_before", DBField: "duedate", Type: "timestamp", Comparison: "<"},
+		{URLField: "due_after", DBField: "duedate", Type: "timestamp", Comparison: ">"},
+		{URLField: "created_after", DBField: "created", Type: "timestamp", Comparison: ">"},
+		{URLField: "has_due_date", DBField: "duedate", Type: "presence"},
+	}
+	var filterTests = []struct {
+		values      map[string]string
+		expectedIDs []int
+	}{
+		{map[string]string{"due_before": "now"}, []int{1}},
+		{map[string]string{"due_after": "now", "due_before": "now+1w"}, []int{2}},
+		{map[string]string{"due_after": "now+4d"}, []int{}},
+		{map[string]string{"created_after": "now-1h"}, []int{1, 2, 3}},
+		{map[string]string{"created_after": "now+1h"}, []int{}},
+		{map[string]string{"has_due_date": "false"}, []int{3}},
+		{map[string]string{"has_due_date": "true"}, []int{1, 2}},
+	}
+
+	for _, ft := range filterTests {
+		q, err := clauses.BuildQueryClauseFromRequest(ft.values, allowedWhere, nil)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		tasks, err := s.SelectTasks(testContext, q)
+		if err != nil {
+			t.Fatalf("selecting tasks: %v", err)
+		}
+		ids := []int{}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(ft.expectedIDs) {
+			t.Errorf("%v: got %v, wanted %v", ft.values, ids, ft.expectedIDs)
+		}
+	}
+}
+
+func TestMemoryFilterExpression(t *testing.T) {
+	checkFilterExpression(t, NewMemoryPersistenceManager())
+}
+
+// checkFilterExpression lists tasks using filter expressions
+// along with simple filters
+func checkFilterExpression(t *testing.T, s TaskStore) {
+	for _, task := range []types.Task{
+		{Name: "buy milk", Category: "home", Status: types.StatusPending},
+		{Name: "fix roof", Category: "home", Status: types.StatusStarted},
+		{Name: "old plans", Category: "archive", Status: types.StatusPending},
+		{Name: "buy car", Category: "work", Status: types.StatusFinished},
+	} {
+		task := task
+		if _, err := s.CreateTask(testContext, &task); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "id", DBField: "id", Type: "integer", Operators: []string{"eq", "gt"}},
+		{URLField: "name", DBField: "name", Type: "string", Operators: []string{"eq", "like"}},
+		{URLField: "category", DBField: "category", Type: "string", Operators: []string{"eq", "ne"}},
+		{URLField: "status", DBField: "status", Type: "string", Operators: []string{"eq", "in"}},
+	}
+	var filterTests = []struct {
+		values      map[string]string
+		expectedIDs []int
+	}{
+		{map[string]string{"filter": "(status==pending,status==started);category!=archive"}, []int{1, 2}},
+		{map[string]string{"filter": "name=like=buy* or category==archive"}, []int{1, 3, 4}},
+		{map[string]string{"filter": "status=in=(pending,finished),id==2", "category": "home"}, []int{1, 2}},
+		{map[string]string{"filter": "id=gt=1;(name=='buy car',status==pending)"}, []int{3, 4}},
+	}
+
+	for _, ft := range filterTests {
+		q, err := clauses.BuildQueryClauseFromRequest(ft.values, allowedWhere, nil)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		tasks, err := s.SelectTasks(testContext, q)
+		if err != nil {
+			t.Fatalf("selecting tasks: %v", err)
+		}
+		ids := []int{}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(ft.expectedIDs) {
+			t.Errorf("%v: got %v, wanted %v", ft.values, ids, ft.expectedIDs)
+		}
+	}
+}
+
+func TestMemoryTaskFields(t *testing.T) {
+	checkTaskFields(t, NewMemoryPersistenceManager())
+}
+
+// checkTaskFields retrieves tasks limited to some fields
+func checkTaskFields(t *testing.T, s TaskStore) {
+	due := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, name := range []string{"b", "a"} {
+		_, err := s.CreateTask(testContext, &types.Task{
+			Name: name, Description: "d", Category: "c", Status: types.StatusPending, DueDate: &due})
+		if err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	q, err := clauses.BuildQueryClauseFromRequest(map[string]string{"order": "name"}, nil, testAllowedOrder)
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	q.Fields = []string{"status"}
+	tasks, err := s.SelectTasks(testContext, q)
+	if err != nil {
+		t.Fatalf("selecting tasks: %v", err)
+	}
+	expected := []types.Task{
+		{ID: 2, Name: "a", Status: types.StatusPending, Version: 1},
+		{ID: 1, Name: "b", Status: types.StatusPending, Version: 1},
+	}
+	if fmt.Sprintf("%+v", tasks) != fmt.Sprintf("%+v", expected) {
+		t.Errorf("got %+v, wanted %+v", tasks, expected)
+	}
+
+	task, err := s.GetTask(testContext, 1, "duedate", "category")
+	if err != nil {
+		t.Fatalf("getting task: %v", err)
+	}
+	if task == nil || task.ID != 1 || task.Version != 1 || task.Category != "c" ||
+		task.DueDate == nil || !task.DueDate.Equal(due) ||
+		task.Name != "" || task.Description != "" || task.Status != "" || task.Created != nil {
+		t.Errorf("got %+v, wanted id, version, category and due date", task)
+	}
+
+	if _, err = s.GetTask(testContext, 1, "tenant"); err == nil {
+		t.Error("got no error retrieving an unknown field")
+	}
+}
+
+func TestMemoryNullOrdering(t *testing.T) {
+	checkNullOrdering(t, NewMemoryPersistenceManager())
+}
+
+// checkNullOrdering lists tasks by due date following cursors,
+// placing tasks without due date as requested
+func checkNullOrdering(t *testing.T, s TaskStore) {
+	early := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	late := early.Add(24 * time.Hour)
+	for _, due := range []*time.Time{nil, &late, &early, nil, &late} {
+		if _, err := s.CreateTask(testContext, &types.Task{Name: "a", Status: types.StatusPending, DueDate: due}); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	var orderTests = []struct {
+		order       string
+		expectedIDs []int
+	}{
+		{"due_date", []int{3, 2, 5, 1, 4}},
+		{"due_date:desc", []int{1, 4, 2, 5, 3}},
+		{"due_date:asc:nullsfirst", []int{1, 4, 3, 2, 5}},
+		{"due_date:nullsfirst", []int{1, 4, 3, 2, 5}},
+		{"due_date:desc:nullslast", []int{2, 5, 3, 1, 4}},
+		{"status,due_date:desc,id:desc", []int{4, 1, 5, 2, 3}},
+	}
+
+	for _, ot := range orderTests {
+		t.Run(fmt.Sprintf("order %s", ot.order),
+			func(t *testing.T) {
+				for _, pageSize := range []string{"10", "2"} {
+					ids := selectPages(t, s, map[string]string{"order": ot.order, "page_size": pageSize})
+					if fmt.Sprint(ids) != fmt.Sprint(ot.expectedIDs) {
+						t.Errorf("page size %s got %v, wanted %v", pageSize, ids, ot.expectedIDs)
+					}
+				}
+			})
+	}
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// purgeBatchSize is the number of tasks purged at each transaction
+const purgeBatchSize = 100
+
+// TaskPurger is implemented by stores that can permanently remove
+// logically deleted tasks of all tenants
+type TaskPurger interface {
+	// PurgeDeletedTasks removes the tasks deleted before a time,
+	// returning the number of purged tasks.
+	// A delete revision and event are recorded for each of them
+	PurgeDeletedTasks(ctx context.Context, before time.Time) (int, error)
+}
+
+var (
+	_ TaskPurger = &PersistenceManager{}
+	_ TaskPurger = &MemoryPersistenceManager{}
+)
+
+// RunTaskPurger removes tasks deleted longer than retention ago
+// every interval, until the context is done
+func RunTaskPurger(ctx context.Context, purger TaskPurger, retention, interval time.Duration) {
+	log.V(5).Info("purging deleted tasks",
+		"retention", retention.String(),
+		"interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := purger.PurgeDeletedTasks(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Error(err, "error purging deleted tasks")
+		} else if n != 0 {
+			log.Info("purged deleted tasks", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDeletedTasks removes the tasks deleted before a time, in batches
+func (p *PersistenceManager) PurgeDeletedTasks(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for {
+		n, found, err := p.purgeDeletedTasksBatch(ctx, before.UTC())
+		purged += n
+		if err != nil || found < purgeBatchSize {
+			return purged, err
+		}
+	}
+}
+
+// purgeDeletedTasksBatch removes a batch of tasks deleted before a time,
+// returning the number of purged and found tasks. Tasks restored
+// since they were read are not purged
+func (p *PersistenceManager) purgeDeletedTasksBatch(ctx context.Context, before time.Time) (int, int, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, wrapError(ctx, err, "error starting PurgeDeletedTasks transaction")
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		select
+			id,
+			tenant,
+			name,
+			description,
+			category,
+			status,
+			duedate,
+			created,
+			version
+		from tasks
+		where deleted_at < $1
+		order by id
+		limit $2`
+	log.V(10).Info("Executing query",
+		"query", query,
+		"before", before)
+
+	rows, err := tx.QueryContext(ctx, p.rebind(query), before, purgeBatchSize)
+	if err != nil {
+		return 0, 0, wrapError(ctx, err, "error retrieving deleted Tasks")
+	}
+	tenants := []string{}
+	items := []types.Task{}
+	for rows.Next() {
+		var (
+			item     types.Task
+			tenantID string
+		)
+		if err = rows.Scan(
+			&item.ID,
+			&tenantID,
+			&item.Name,
+			&item.Description,
+			&item.Category,
+			&item.Status,
+			&item.DueDate,
+			&item.Created,
+			&item.Version); err != nil {
+			_ = rows.Close()
+			return 0, 0, wrapError(ctx, err, "error scanning deleted Tasks")
+		}
+		tenants = append(tenants, tenantID)
+		items = append(items, item)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return 0, 0, wrapError(ctx, err, "error retrieving deleted Tasks")
+	}
+
+	purged := 0
+	for i := range items {
+		item := &items[i]
+		res, err := tx.ExecContext(ctx,
+			p.rebind("delete from tasks where id = $1 and version = $2 and deleted_at is not null"),
+			item.ID, item.Version)
+		if err != nil {
+			return 0, 0, wrapError(ctx, err, "error purging Task")
+		}
+		if err = checkVersionMatched(res); err == ErrVersionConflict {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		if err = p.recordRevision(ctx, tx, tenants[i], types.OperationDelete, item.ID, item, nil); err != nil {
+			return 0, 0, err
+		}
+		if err = p.recordTaskEvent(ctx, tx, tenants[i], types.OperationDelete, item); err != nil {
+			return 0, 0, err
+		}
+		purged++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, wrapError(ctx, err, "error committing PurgeDeletedTasks transaction")
+	}
+	if purged != 0 {
+		p.dispatcher.wake()
+	}
+	return purged, len(items), nil
+}
+
+// PurgeDeletedTasks removes the tasks deleted before a time
+func (m *MemoryPersistenceManager) PurgeDeletedTasks(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "error purging Tasks")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := []int{}
+	for id, deletedAt := range m.deletedAt {
+		if deletedAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		t := m.tasks[id]
+		tenantID := m.tenants[id]
+		delete(m.tasks, id)
+		delete(m.tenants, id)
+		delete(m.deletedAt, id)
+		delete(m.previousStatus, id)
+		m.recordRevision(tenantID, types.OperationDelete, id, t, nil)
+		m.recordTaskEvent(tenantID, types.OperationDelete, t)
+	}
+	if len(ids) != 0 {
+		m.dispatcher.wake()
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// checkPurge deletes tasks logically at a store and checks that only
+// those deleted before the purge time are removed
+func checkPurge(t *testing.T, s TaskStore, purger TaskPurger, outbox taskEventOutbox) {
+	ids := map[string]int{}
+	for _, name := range []string{"kept", "deleted", "restored"} {
+		task, err := s.CreateTask(testContext, &types.Task{Name: name, Status: types.StatusPending})
+		if err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+		ids[name] = task.ID
+		if name == "kept" {
+			continue
+		}
+		task.Status = types.StatusDeleted
+		if task, err = s.UpdateOneTask(testContext, task); err != nil {
+			t.Fatalf("deleting task: %v", err)
+		}
+		if name == "restored" {
+			task.Status = types.StatusPending
+			if _, err = s.UpdateOneTask(testContext, task); err != nil {
+				t.Fatalf("restoring task: %v", err)
+			}
+		}
+	}
+
+	n, err := purger.PurgeDeletedTasks(context.Background(), time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Errorf("got %d purged tasks and error %v before retention, wanted none", n, err)
+	}
+
+	n, err = purger.PurgeDeletedTasks(context.Background(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("purging tasks: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("got %d purged tasks, wanted 1", n)
+	}
+
+	for name, id := range ids {
+		task, err := s.GetTask(testContext, id)
+		if err != nil {
+			t.Fatalf("getting task: %v", err)
+		}
+		if (task == nil) != (name == "deleted") {
+			t.Errorf("got %+v for task %q", task, name)
+		}
+	}
+
+	revisions, err := s.TaskHistory(testContext, ids["deleted"], &clauses.Query{})
+	if err != nil {
+		t.Fatalf("getting history: %v", err)
+	}
+	if len(revisions) != 3 || revisions[2].Operation != types.OperationDelete {
+		t.Errorf("got revisions %+v, wanted a final delete", revisions)
+	}
+
+	last, err := outbox.lastTaskEvent(context.Background())
+	if err != nil {
+		t.Fatalf("reading last event: %v", err)
+	}
+	events, err := outbox.taskEventsAfter(context.Background(), last-1, 1)
+	if err != nil {
+		t.Fatalf("reading events: %v", err)
+	}
+	if len(events) != 1 || events[0].Operation != types.OperationDelete ||
+		events[0].Tenant != "default" || events[0].Task.ID != ids["deleted"] {
+		t.Errorf("got events %+v, wanted purged task delete", events)
+	}
+}
+
+func TestMemoryPurgeDeletedTasks(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+	checkPurge(t, m, m, m)
+}
+
+func TestSQLitePurgeDeletedTasks(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+	checkPurge(t, p, p, p)
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// TaskHistory returns the recorded revisions for a task, oldest first
+func (p *PersistenceManager) TaskHistory(ctx context.Context, ID int, q *clauses.Query) ([]types.TaskRevision, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			id,
+			task_id,
+			operation,
+			old_value,
+			new_value,
+			created
+		from task_revisions
+		where task_id = $1 and tenant = $2
+		order by id`
+	if pag := p.paginationClause(q); len(pag) != 0 {
+		query = fmt.Sprintf("%s %s", query, pag)
+	}
+
+	log.V(10).Info("Executing query",
+		"query", query,
+		"ID", ID)
+
+	stmt, err := p.prepare(ctx, p.reader(ctx), query)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error preparing TaskHistory statement")
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, ID, tenantID)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error retrieving Task revisions")
+	}
+	defer rows.Close()
+
+	items := []types.TaskRevision{}
+	for rows.Next() {
+		var (
+			item     types.TaskRevision
+			oldValue sql.NullString
+			newValue sql.NullString
+		)
+		if err = rows.Scan(
+			&item.ID,
+			&item.TaskID,
+			&item.Operation,
+			&oldValue,
+			&newValue,
+			&item.Created); err != nil {
+			return nil, wrapError(ctx, err, "error scanning Task revisions")
+		}
+		if item.Old, err = unmarshalRevisionValue(oldValue); err != nil {
+			return nil, err
+		}
+		if item.New, err = unmarshalRevisionValue(newValue); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapError(ctx, err, "error retrieving Task revisions")
+	}
+	return items, nil
+}
+
+// recordRevision stores a tenant task change, it is meant to be called
+// in the same transaction that modifies the task
+func (p *PersistenceManager) recordRevision(ctx context.Context, ex executor, tenantID, operation string, ID int, old, new *types.Task) error {
+	query := `
+		insert into task_revisions
+		(
+			task_id,
+			operation,
+			old_value,
+			new_value,
+			tenant
+		)
+		values
+			($1, $2, $3, $4, $5)`
+
+	oldValue, err := marshalRevisionValue(old)
+	if err != nil {
+		return err
+	}
+	newValue, err := marshalRevisionValue(new)
+	if err != nil {
+		return err
+	}
+
+	log.V(10).Info("Executing query",
+		"query", query,
+		"ID", ID,
+		"operation", operation)
+
+	stmt, err := p.prepare(ctx, ex, query)
+	if err != nil {
+		return wrapError(ctx, err, "error preparing recordRevision statement")
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.ExecContext(ctx, ID, operation, oldValue, newValue, tenantID); err != nil {
+		return wrapError(ctx, err, "error recording Task revision")
+	}
+	return nil
+}
+
+// marshalRevisionValue turns a task into its stored JSON representation
+func marshalRevisionValue(t *types.Task) (sql.NullString, error) {
+	if t == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return sql.NullString{}, errors.Wrap(err, "error marshaling Task revision")
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// unmarshalRevisionValue reads a task from its stored JSON representation
+func unmarshalRevisionValue(v sql.NullString) (*types.Task, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	t := &types.Task{}
+	if err := json.Unmarshal([]byte(v.String), t); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling Task revision")
+	}
+	return t, nil
+}
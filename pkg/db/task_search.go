@@ -0,0 +1,38 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+)
+
+// taskSearchDocument is the text tasks are searched on, it must
+// match the expression used at the tasks_search index
+const taskSearchDocument = `to_tsvector('english', name || ' ' || coalesce(description, ''))`
+
+// searchClause returns a where clause matching the search terms and an
+// order by clause for relevance ranking. Search parameters are appended
+// to params and numbered after them.
+// Postgres uses full text search, other drivers look for all
+// search terms at name or description
+func (p *PersistenceManager) searchClause(search string, params []interface{}) (string, string, []interface{}) {
+	if p.driver == PostgresDriver {
+		n := len(params) + 1
+		where := fmt.Sprintf("%s @@ plainto_tsquery('english', $%d)", taskSearchDocument, n)
+		rank := fmt.Sprintf("ts_rank(%s, plainto_tsquery('english', $%d)) desc, id", taskSearchDocument, n)
+		return where, rank, append(params, search)
+	}
+
+	where := strings.Builder{}
+	for i, term := range strings.Fields(search) {
+		n := len(params) + 1
+		if i != 0 {
+			where.WriteString(" and ")
+		}
+		where.WriteString(fmt.Sprintf(
+			`(name like $%d escape '\' or coalesce(description, '') like $%d escape '\')`, n, n))
+		params = append(params, "%"+clauses.LikeEscaper.Replace(term)+"%")
+	}
+	return where.String(), "id", params
+}
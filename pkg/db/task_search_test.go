@@ -0,0 +1,148 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+func TestSearchClause(t *testing.T) {
+	var testData = []struct {
+		testName       string
+		driver         string
+		search         string
+		params         []interface{}
+		expectedWhere  string
+		expectedRank   string
+		expectedParams []interface{}
+	}{
+		{
+			testName:       "postgres full text search",
+			driver:         PostgresDriver,
+			search:         "buy milk",
+			params:         []interface{}{"pending"},
+			expectedWhere:  "to_tsvector('english', name || ' ' || coalesce(description, '')) @@ plainto_tsquery('english', $2)",
+			expectedRank:   "ts_rank(to_tsvector('english', name || ' ' || coalesce(description, '')), plainto_tsquery('english', $2)) desc, id",
+			expectedParams: []interface{}{"pending", "buy milk"},
+		},
+		{
+			testName:       "sqlite like search",
+			driver:         SQLiteDriver,
+			search:         "buy 100%",
+			params:         nil,
+			expectedWhere:  `(name like $1 escape '\' or coalesce(description, '') like $1 escape '\') and (name like $2 escape '\' or coalesce(description, '') like $2 escape '\')`,
+			expectedRank:   "id",
+			expectedParams: []interface{}{"%buy%", `%100\%%`},
+		},
+	}
+
+	for _, td := range testData {
+		p := &PersistenceManager{driver: td.driver}
+		where, rank, params := p.searchClause(td.search, td.params)
+		if where != td.expectedWhere {
+			t.Errorf("%q: got where %q, wanted %q", td.testName, where, td.expectedWhere)
+		}
+		if rank != td.expectedRank {
+			t.Errorf("%q: got rank %q, wanted %q", td.testName, rank, td.expectedRank)
+		}
+		if !reflect.DeepEqual(params, td.expectedParams) {
+			t.Errorf("%q: got params %v, wanted %v", td.testName, params, td.expectedParams)
+		}
+	}
+}
+
+func TestSQLiteSearchTasks(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+
+	for _, task := range []types.Task{
+		{Name: "groceries", Description: "buy milk", Category: "home", Status: types.StatusPending},
+		{Name: "milk the cow", Category: "farm", Status: types.StatusPending},
+		{Name: "buy milk", Category: "home", Status: types.StatusFinished},
+	} {
+		task := task
+		if _, err := p.CreateTask(testContext, &task); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	q, err := clauses.BuildQueryClauseFromRequest(
+		map[string]string{"q": "Milk buy", "status": "pending"},
+		[]clauses.AllowedWhere{{URLField: "status", DBField: "status", Type: "string"}},
+		nil)
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	tasks, err := p.SelectTasks(testContext, q)
+	if err != nil {
+		t.Fatalf("selecting tasks: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Name != "groceries" {
+		t.Errorf("unexpected tasks %+v", tasks)
+	}
+
+	count, err := p.CountTasks(testContext, q)
+	if err != nil {
+		t.Fatalf("counting tasks: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("got count %d, wanted 1", count)
+	}
+}
+
+func TestMemorySearchRelevance(t *testing.T) {
+	m := NewMemoryPersistenceManager()
+	for _, task := range []types.Task{
+		{Name: "groceries", Description: "buy milk", Status: types.StatusPending},
+		{Name: "milk the cow", Description: "milk twice a day", Status: types.StatusPending},
+		{Name: "buy milk", Description: "buy milk for the cow", Status: types.StatusPending},
+		{Name: "bread", Status: types.StatusPending},
+	} {
+		task := task
+		if _, err := m.CreateTask(testContext, &task); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	var testData = []struct {
+		testName      string
+		values        map[string]string
+		expectedNames []string
+	}{
+		{
+			testName:      "relevance order",
+			values:        map[string]string{"q": "milk buy"},
+			expectedNames: []string{"buy milk", "groceries"},
+		},
+		{
+			testName:      "relevance order with ties",
+			values:        map[string]string{"q": "milk"},
+			expectedNames: []string{"milk the cow", "buy milk", "groceries"},
+		},
+		{
+			testName:      "explicit order",
+			values:        map[string]string{"q": "milk", "order": "name"},
+			expectedNames: []string{"buy milk", "groceries", "milk the cow"},
+		},
+	}
+
+	for _, td := range testData {
+		q, err := clauses.BuildQueryClauseFromRequest(td.values, nil, testAllowedOrder)
+		if err != nil {
+			t.Fatalf("%q: building query: %v", td.testName, err)
+		}
+		tasks, err := m.SelectTasks(testContext, q)
+		if err != nil {
+			t.Fatalf("%q: selecting tasks: %v", td.testName, err)
+		}
+		names := []string{}
+		for _, task := range tasks {
+			names = append(names, task.Name)
+		}
+		if !reflect.DeepEqual(names, td.expectedNames) {
+			t.Errorf("%q: got tasks %v, wanted %v", td.testName, names, td.expectedNames)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// Fields tasks can be grouped by at stats
+const (
+	StatsByStatus   = "status"
+	StatsByCategory = "category"
+	// StatsByDue groups tasks by due date bucket, see types.DueOverdue
+	StatsByDue = "due"
+)
+
+// StatsGroups lists the fields tasks can be grouped by at stats
+var StatsGroups = []string{StatsByStatus, StatsByCategory, StatsByDue}
+
+// statsNow returns the time due date buckets are computed from
+var statsNow = time.Now
+
+// dueLimits returns the limits of the today and this week due date
+// buckets for a time, the start of the next day and of the next
+// week starting on Monday, in UTC
+func dueLimits(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// days since Monday
+	weekday := (int(today.Weekday()) + 6) % 7
+	return today.AddDate(0, 0, 1), today.AddDate(0, 0, 7-weekday)
+}
+
+// dueBucket returns the due date bucket of a task at a time
+func dueBucket(due *time.Time, now time.Time) string {
+	tomorrow, nextWeek := dueLimits(now)
+	switch {
+	case due == nil:
+		return types.DueNone
+	case due.Before(now):
+		return types.DueOverdue
+	case due.Before(tomorrow):
+		return types.DueToday
+	case due.Before(nextWeek):
+		return types.DueThisWeek
+	}
+	return types.DueLater
+}
+
+// checkStatsGroups rejects unknown stats group fields
+func checkStatsGroups(groupBy []string) error {
+	for _, g := range groupBy {
+		known := false
+		for _, s := range StatsGroups {
+			known = known || g == s
+		}
+		if !known {
+			return errors.Errorf("tasks can't be grouped by %s", g)
+		}
+	}
+	return nil
+}
+
+// sortTaskCounts sorts task counts by their group values
+func sortTaskCounts(counts []types.TaskCount, groupBy []string) {
+	sort.Slice(counts, func(i, j int) bool {
+		for _, g := range groupBy {
+			if a, b := counts[i].Group[g], counts[j].Group[g]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+}
+
+// TaskStats counts the tasks matching a query filters grouped by
+// some of StatsGroups, a single count is returned if not grouped.
+// Ordering and pagination are ignored
+func (p *PersistenceManager) TaskStats(ctx context.Context, q *clauses.Query, groupBy []string) ([]types.TaskCount, error) {
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatsGroups(groupBy); err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	where, params, _ := p.tasksWhere(q, tenantID)
+	columns := make([]string, len(groupBy))
+	for i, g := range groupBy {
+		if g != StatsByDue {
+			columns[i] = g
+			continue
+		}
+		now := statsNow().UTC()
+		tomorrow, nextWeek := dueLimits(now)
+		params = append(params, now, tomorrow, nextWeek)
+		n := len(params)
+		columns[i] = fmt.Sprintf("case when duedate is null then '%s' when duedate < $%d then '%s' "+
+			"when duedate < $%d then '%s' when duedate < $%d then '%s' else '%s' end",
+			types.DueNone, n-2, types.DueOverdue, n-1, types.DueToday, n, types.DueThisWeek, types.DueLater)
+	}
+
+	query := fmt.Sprintf("select count(*) from tasks where %s", where)
+	if len(columns) != 0 {
+		positions := make([]string, len(columns))
+		for i := range columns {
+			positions[i] = fmt.Sprint(i + 1)
+		}
+		query = fmt.Sprintf("select %s, count(*) from tasks where %s group by %s",
+			strings.Join(columns, ", "), where, strings.Join(positions, ", "))
+	}
+
+	log.V(10).Info("Executing query",
+		"query", query,
+		"parameters", params)
+
+	stmt, err := p.prepare(ctx, p.reader(ctx), query)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error preparing TaskStats statement")
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, wrapError(ctx, err, "error counting Tasks")
+	}
+	defer rows.Close()
+
+	counts := []types.TaskCount{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(groupBy))
+		dest := make([]interface{}, len(groupBy)+1)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		count := types.TaskCount{}
+		dest[len(groupBy)] = &count.Count
+		if err = rows.Scan(dest...); err != nil {
+			return nil, wrapError(ctx, err, "error scanning Task counts")
+		}
+		if len(groupBy) != 0 {
+			count.Group = make(map[string]string, len(groupBy))
+			for i, g := range groupBy {
+				count.Group[g] = values[i].String
+			}
+		}
+		counts = append(counts, count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrapError(ctx, err, "error counting Tasks")
+	}
+	sortTaskCounts(counts, groupBy)
+	return counts, nil
+}
+
+// TaskStats counts the stored tasks matching a query filters grouped by
+// some of StatsGroups, a single count is returned if not grouped.
+// Ordering and pagination are ignored
+func (m *MemoryPersistenceManager) TaskStats(ctx context.Context, q *clauses.Query, groupBy []string) ([]types.TaskCount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error counting Tasks")
+	}
+	tenantID, err := contextTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatsGroups(groupBy); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := statsNow()
+	counts := []types.TaskCount{}
+	index := map[string]int{}
+	if len(groupBy) == 0 {
+		// a count is returned even if no task matches
+		counts = append(counts, types.TaskCount{})
+		index[""] = 0
+	}
+	for _, t := range m.tasks {
+		if m.tenants[t.ID] != tenantID {
+			continue
+		}
+		match, err := matchQuery(t, q)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+
+		group := make(map[string]string, len(groupBy))
+		key := make([]string, len(groupBy))
+		for i, g := range groupBy {
+			switch g {
+			case StatsByStatus:
+				group[g] = t.Status
+			case StatsByCategory:
+				group[g] = t.Category
+			case StatsByDue:
+				group[g] = dueBucket(t.DueDate, now)
+			}
+			key[i] = group[g]
+		}
+		k := strings.Join(key, "\x00")
+		i, ok := index[k]
+		if !ok {
+			i = len(counts)
+			index[k] = i
+			counts = append(counts, types.TaskCount{Group: group})
+		}
+		counts[i].Count++
+	}
+	sortTaskCounts(counts, groupBy)
+	return counts, nil
+}
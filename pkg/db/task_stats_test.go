@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+func TestDueBucket(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)
+	sunday := time.Date(2030, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	var bucketTests = []struct {
+		due      string
+		now      time.Time
+		expected string
+	}{
+		{"", now, types.DueNone},
+		{"2030-01-02T11:59:59Z", now, types.DueOverdue},
+		{"2030-01-02T12:00:00Z", now, types.DueToday},
+		{"2030-01-02T23:59:59Z", now, types.DueToday},
+		{"2030-01-03T00:00:00Z", now, types.DueThisWeek},
+		{"2030-01-06T23:59:59Z", now, types.DueThisWeek},
+		{"2030-01-07T00:00:00Z", now, types.DueLater},
+		{"2030-01-06T23:00:00Z", sunday, types.DueToday},
+		{"2030-01-07T00:00:00Z", sunday, types.DueLater},
+	}
+
+	for _, bt := range bucketTests {
+		var due *time.Time
+		if bt.due != "" {
+			d, err := time.Parse(time.RFC3339, bt.due)
+			if err != nil {
+				t.Fatalf("parsing due date: %v", err)
+			}
+			due = &d
+		}
+		if b := dueBucket(due, bt.now); b != bt.expected {
+			t.Errorf("got %s for %q at %v, wanted %s", b, bt.due, bt.now, bt.expected)
+		}
+	}
+}
+
+// checkTaskStats counts tasks grouped by status, category and due date
+func checkTaskStats(t *testing.T, s TaskStore) {
+	defer func(f func() time.Time) { statsNow = f }(statsNow)
+	statsNow = func() time.Time { return time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC) }
+
+	date := func(day, hour int) *time.Time {
+		d := time.Date(2030, 1, day, hour, 0, 0, 0, time.UTC)
+		return &d
+	}
+	for _, task := range []types.Task{
+		{Name: "a", Category: "home", Status: types.StatusPending, DueDate: date(1, 10)},
+		{Name: "b", Category: "home", Status: types.StatusPending, DueDate: date(2, 18)},
+		{Name: "c", Category: "work", Status: types.StatusStarted, DueDate: date(4, 10)},
+		{Name: "d", Category: "work", Status: types.StatusPending, DueDate: date(9, 10)},
+		{Name: "e", Category: "work", Status: types.StatusPending},
+	} {
+		task := task
+		if _, err := s.CreateTask(testContext, &task); err != nil {
+			t.Fatalf("creating task: %v", err)
+		}
+	}
+
+	allowedWhere := []clauses.AllowedWhere{
+		{URLField: "status", DBField: "status", Type: "string"},
+	}
+	var statsTests = []struct {
+		values   map[string]string
+		groupBy  []string
+		expected string
+	}{
+		{map[string]string{}, nil, "[{map[] 5}]"},
+		{map[string]string{"status": "finished"}, nil, "[{map[] 0}]"},
+		{map[string]string{}, []string{StatsByStatus},
+			"[{map[status:pending] 4} {map[status:started] 1}]"},
+		{map[string]string{"status": "pending"}, []string{StatsByCategory, StatsByStatus},
+			"[{map[category:home status:pending] 2} {map[category:work status:pending] 2}]"},
+		{map[string]string{}, []string{StatsByDue},
+			"[{map[due:later] 1} {map[due:none] 1} {map[due:overdue] 1} {map[due:this_week] 1} {map[due:today] 1}]"},
+		{map[string]string{"filter": "status==started"}, []string{StatsByDue, StatsByCategory},
+			"[{map[category:work due:this_week] 1}]"},
+	}
+
+	for _, st := range statsTests {
+		q, err := clauses.WhereQueryFromRequest(st.values, allowedWhere)
+		if err != nil {
+			t.Fatalf("building query: %v", err)
+		}
+		counts, err := s.TaskStats(testContext, q, st.groupBy)
+		if err != nil {
+			t.Fatalf("counting tasks: %v", err)
+		}
+		if fmt.Sprint(counts) != st.expected {
+			t.Errorf("%v by %v: got %v, wanted %s", st.values, st.groupBy, counts, st.expected)
+		}
+	}
+
+	if _, err := s.TaskStats(testContext, &clauses.Query{}, []string{"name"}); err == nil {
+		t.Error("got no error grouping by an unknown field")
+	}
+}
+
+func TestMemoryTaskStats(t *testing.T) {
+	checkTaskStats(t, NewMemoryPersistenceManager())
+}
+
+func TestSQLiteTaskStats(t *testing.T) {
+	p := newSQLiteTestManager(t)
+	defer p.db.Close()
+	checkTaskStats(t, p)
+}
@@ -1,6 +1,9 @@
 package parameters
 
-import "net/url"
+import (
+	"net/url"
+	"strings"
+)
 
 // URLValuesToMap will generate a string map from URL values
 func URLValuesToMap(values url.Values) map[string]string {
@@ -12,3 +15,19 @@ func URLValuesToMap(values url.Values) map[string]string {
 	}
 	return r
 }
+
+// IfMatch checks an If-Match header value against an entity tag.
+// An empty header or a wildcard always match, weak tags are compared
+// as strong ones
+func IfMatch(header, etag string) bool {
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, h := range strings.Split(header, ",") {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "W/")
+		if h == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package response
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"net/http"
@@ -18,12 +19,18 @@ const ticketPrefix = "todolist"
 
 // ErrorResponse turns an error into a JSON response
 func ErrorResponse(res *restful.Response, code int, err error) {
+	ErrorDetailsResponse(res, code, err, nil)
+}
+
+// ErrorDetailsResponse turns an error into a JSON response
+// including details that help clients recover from it
+func ErrorDetailsResponse(res *restful.Response, code int, err error, details map[string]interface{}) {
 	t := generateUniqueTicket()
-	WriteJSON(
-		res,
-		code,
-		map[string]string{"message": err.Error(), "tracking": t},
-	)
+	payload := map[string]interface{}{"message": err.Error(), "tracking": t}
+	for k, v := range details {
+		payload[k] = v
+	}
+	WriteJSON(res, code, payload)
 
 	var level string
 	if code == http.StatusInternalServerError {
@@ -66,6 +73,21 @@ func InternalServerErrorResponse(res *restful.Response, err error) {
 	)
 }
 
+// ServerErrorResponse turns an error produced while serving a request
+// into a JSON response. Operations that timed out are reported as
+// gateway timeout, those canceled (client gone or server shutting down)
+// as service unavailable, and any other error as internal server error
+func ServerErrorResponse(res *restful.Response, err error) {
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded:
+		ErrorResponse(res, http.StatusGatewayTimeout, err)
+	case context.Canceled:
+		ErrorResponse(res, http.StatusServiceUnavailable, err)
+	default:
+		InternalServerErrorResponse(res, err)
+	}
+}
+
 func generateUniqueTicket() string {
 	t := fmt.Sprintf("%s-%s", ticketPrefix, time.Now().Format("20060102150405"))
 	b := make([]byte, 8)
@@ -1,7 +1,11 @@
 package response
 
 import (
+	"bytes"
+	"encoding/json"
+
 	restful "github.com/emicklei/go-restful"
+	"github.com/pkg/errors"
 )
 
 // WriteJSON formats a message response into JSON
@@ -18,3 +22,46 @@ func WriteJSON(res *restful.Response, code int, payload interface{}) {
 	// w.Write(response)
 	// }
 }
+
+// Fields keeps only the named fields of a JSON object payload, or of
+// each object at an array payload, dropping any other field
+func Fields(payload interface{}, fields []string) (interface{}, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling payload")
+	}
+
+	keep := func(object map[string]json.RawMessage) {
+		for k := range object {
+			if !containsString(fields, k) {
+				delete(object, k)
+			}
+		}
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		objects := []map[string]json.RawMessage{}
+		if err = json.Unmarshal(b, &objects); err != nil {
+			return nil, errors.Wrap(err, "error projecting payload fields")
+		}
+		for _, o := range objects {
+			keep(o)
+		}
+		return objects, nil
+	}
+
+	object := map[string]json.RawMessage{}
+	if err = json.Unmarshal(b, &object); err != nil {
+		return nil, errors.Wrap(err, "error projecting payload fields")
+	}
+	keep(object)
+	return object, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -6,20 +6,33 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	restful "github.com/emicklei/go-restful"
 	restfulspec "github.com/emicklei/go-restful-openapi"
 
+	"github.com/odacremolbap/rest-demo/pkg/db"
 	"github.com/odacremolbap/rest-demo/pkg/log"
 	"github.com/odacremolbap/rest-demo/pkg/server/services"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
 )
 
+// ReadPrimaryHeader asks for reads to be served by the primary database
+// when a read replica is configured, so that clients see their own writes
+const ReadPrimaryHeader = "X-Read-Primary"
+
 // Server HTTP handling server
 type Server struct {
 	Port            int
 	ShutDownTimeout time.Duration
+	// DevTenantHeader trusts the tenant header sent by clients,
+	// it must only be enabled for development
+	DevTenantHeader bool
+	// Authenticator resolves the tenant of API requests, if nil
+	// they are served for the default tenant
+	Authenticator tenant.Authenticator
 }
 
 // NewServer creates a new HTTP server
@@ -33,10 +46,22 @@ func NewServer(port int, shutDownTimeout time.Duration) *Server {
 // Run starts the HTTP server
 func (s *Server) Run() {
 
+	// requests still running after the shutdown timeout are canceled
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	container := restful.DefaultContainer
 	restful.Filter(globalLogging)
+	restful.Filter(requestContext(requestsCtx))
+	restful.Filter(readPrimary)
 	services.Register(container)
 
+	// tenants are only resolved for the API, docs are public
+	tenantFilter := tenant.Filter(s.Authenticator, s.DevTenantHeader)
+	for _, ws := range container.RegisteredWebServices() {
+		ws.Filter(tenantFilter)
+	}
+
 	// TODO, docs can be enhanced using PostBuildSwaggerObjectHandler
 	config := restfulspec.Config{
 		WebServices: container.RegisteredWebServices(),
@@ -58,6 +83,7 @@ func (s *Server) Run() {
 
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Error(err, "error shutting down server")
+			cancelRequests()
 		} else {
 			log.Info("server stopped")
 		}
@@ -70,6 +96,41 @@ func (s *Server) Run() {
 	<-allClosed
 }
 
+// requestContext returns a filter that cancels each request
+// context when the parent context is done
+func requestContext(ctx context.Context) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		reqCtx, cancel := context.WithCancel(req.Request.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+
+		req.Request = req.Request.WithContext(reqCtx)
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// readPrimary sends the reads of write requests, and of requests
+// asking for it at the read primary header, to the primary database.
+// Writes need to read the latest task version to succeed
+func readPrimary(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	primary := req.Request.Method != http.MethodGet && req.Request.Method != http.MethodHead
+	if h := req.HeaderParameter(ReadPrimaryHeader); h != "" {
+		if b, err := strconv.ParseBool(h); err == nil && b {
+			primary = true
+		}
+	}
+	if primary {
+		req.Request = req.Request.WithContext(db.WithPrimary(req.Request.Context()))
+	}
+	chain.ProcessFilter(req, resp)
+}
+
 func globalLogging(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	begin := time.Now()
 	chain.ProcessFilter(req, resp)
@@ -0,0 +1,109 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+func TestTaskFields(t *testing.T) {
+	var testData = []struct {
+		testName         string
+		requestURL       string
+		expectedHTTPCode int
+		expectedKeys     []string
+	}{
+		{
+			testName:         "list fields test",
+			requestURL:       "http://test/v1/tasks?fields=id,name,status",
+			expectedHTTPCode: http.StatusOK,
+			expectedKeys:     []string{"id", "name", "status"},
+		},
+		{
+			testName:         "list ordered fields test",
+			requestURL:       "http://test/v1/tasks?fields=name,due_date&order=name&page_size=1",
+			expectedHTTPCode: http.StatusOK,
+			expectedKeys:     []string{"due_date", "name"},
+		},
+		{
+			testName:         "list all fields test",
+			requestURL:       "http://test/v1/tasks",
+			expectedHTTPCode: http.StatusOK,
+			expectedKeys:     []string{"category", "created", "description", "due_date", "id", "name", "status", "version"},
+		},
+		{
+			testName:         "get fields test",
+			requestURL:       "http://test/v1/tasks/1?fields=description",
+			expectedHTTPCode: http.StatusOK,
+			expectedKeys:     []string{"description"},
+		},
+		{
+			testName:         "unknown field test",
+			requestURL:       "http://test/v1/tasks?fields=id,tenant",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+		{
+			testName:         "get unknown field test",
+			requestURL:       "http://test/v1/tasks/1?fields=owner",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, td := range testData {
+		db.Manager = db.NewMemoryPersistenceManager()
+		due := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+		_, err := db.Manager.CreateTask(
+			tenant.NewContext(context.Background(), tenant.Default),
+			&types.Task{Name: "a", Description: "buy milk", Category: "home", Status: types.StatusPending, DueDate: &due})
+		require.Nil(t, err)
+
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", td.requestURL, nil)
+		require.Nil(t, err)
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - HTTP status", td.testName) {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Log(string(b))
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		object := map[string]interface{}{}
+		if b[0] == '[' {
+			objects := []map[string]interface{}{}
+			if !assert.Nil(t, json.Unmarshal(b, &objects), "%q - decoding tasks", td.testName) ||
+				!assert.Len(t, objects, 1, "%q - tasks", td.testName) {
+				continue
+			}
+			object = objects[0]
+		} else if !assert.Nil(t, json.Unmarshal(b, &object), "%q - decoding task", td.testName) {
+			continue
+		}
+		keys := []string{}
+		for k := range object {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, td.expectedKeys, keys, "%q - task fields", td.testName)
+	}
+}
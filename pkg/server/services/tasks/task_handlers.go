@@ -1,8 +1,11 @@
 package tasks
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	restful "github.com/emicklei/go-restful"
 	"github.com/pkg/errors"
@@ -15,6 +18,16 @@ import (
 	"github.com/odacremolbap/rest-demo/pkg/types"
 )
 
+// listing headers
+const (
+	// nextCursorHeader contains the cursor for the next listing page
+	nextCursorHeader = "X-Next-Cursor"
+	// totalCountHeader contains the number of items matching a listing
+	totalCountHeader = "X-Total-Count"
+	// linkHeader contains links to other listing pages, see RFC 5988
+	linkHeader = "Link"
+)
+
 func (t *TaskResource) listAllTasks(req *restful.Request, res *restful.Response) {
 	log.V(10).Info("listAllTasks handler", "query_params", req.Request.URL.Query())
 
@@ -32,24 +45,120 @@ func (t *TaskResource) listAllTasks(req *restful.Request, res *restful.Response)
 		return
 	}
 
+	fields, err := clauses.FieldsFromRequest(query, allowedFields)
+	if err != nil {
+		response.ErrorResponse(
+			res,
+			http.StatusBadRequest,
+			err)
+		return
+	}
+	q.Fields = dbFields(fields)
+
 	if _, ok := query["watch"]; ok {
 		t.watchTasks(req, res, q)
 		return
 	}
 
-	tts, err := db.Manager.SelectTasks(q)
+	tts, err := db.Manager.SelectTasks(req.Request.Context(), q)
 	if err != nil {
-		response.InternalServerErrorResponse(res, err)
+		response.ServerErrorResponse(res, err)
 		return
 	}
-	response.WriteJSON(res, http.StatusOK, tts)
+
+	// page listings report the total and links to other pages,
+	// cursor listings can't jump to arbitrary pages
+	if q.Cursor == nil {
+		total := len(tts)
+		if q.PageSize != 0 {
+			total, err = db.Manager.CountTasks(req.Request.Context(), q)
+			if err != nil {
+				response.ServerErrorResponse(res, err)
+				return
+			}
+			res.AddHeader(linkHeader, paginationLinks(req.Request.URL, q.Page, q.PageSize, total))
+		}
+		res.AddHeader(totalCountHeader, strconv.Itoa(total))
+	}
+
+	// a full page might be followed by more tasks
+	if q.PageSize != 0 && len(tts) == q.PageSize && len(q.OrderBy) != 0 {
+		cursor, err := db.TaskCursor(q.OrderBy, &tts[len(tts)-1])
+		if err != nil {
+			response.InternalServerErrorResponse(res, err)
+			return
+		}
+		res.AddHeader(nextCursorHeader, cursor)
+	}
+	writeFields(res, tts, fields)
 }
 
 func (t *TaskResource) getOneTask(req *restful.Request, res *restful.Response) {
 	log.V(10).Info("getOneTask handler", "path_params", req.PathParameters())
 
-	task := req.Attribute("task")
-	response.WriteJSON(res, http.StatusOK, task)
+	task := req.Attribute("task").(*types.Task)
+	fields, _ := req.Attribute("fields").([]clauses.AllowedField)
+	res.AddHeader("ETag", taskETag(task))
+	writeFields(res, task, fields)
+}
+
+// dbFields returns the DB fields of projection fields
+func dbFields(fields []clauses.AllowedField) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.DBField
+	}
+	return names
+}
+
+// writeFields writes a tasks payload limited to the requested
+// projection fields, all of them if none was requested
+func writeFields(res *restful.Response, payload interface{}, fields []clauses.AllowedField) {
+	if len(fields) != 0 {
+		names := make([]string, len(fields))
+		for i, f := range fields {
+			names[i] = f.URLField
+		}
+		var err error
+		payload, err = response.Fields(payload, names)
+		if err != nil {
+			response.InternalServerErrorResponse(res, err)
+			return
+		}
+	}
+	response.WriteJSON(res, http.StatusOK, payload)
+}
+
+func (t *TaskResource) getTaskHistory(req *restful.Request, res *restful.Response) {
+	log.V(10).Info("getTaskHistory handler",
+		"path_params", req.PathParameters(),
+		"query_params", req.Request.URL.Query())
+
+	id, err := strconv.Atoi(req.PathParameter("task-id"))
+	if err != nil {
+		response.ErrorResponse(
+			res,
+			http.StatusBadRequest,
+			errors.New("ID must be numeric"))
+		return
+	}
+
+	// history only supports pagination
+	q, err := clauses.BuildQueryClauseFromRequest(
+		parameters.URLValuesToMap(req.Request.URL.Query()),
+		nil,
+		nil)
+	if err != nil {
+		response.ErrorResponse(res, http.StatusBadRequest, err)
+		return
+	}
+
+	revisions, err := db.Manager.TaskHistory(req.Request.Context(), id, q)
+	if err != nil {
+		response.ServerErrorResponse(res, err)
+		return
+	}
+	response.WriteJSON(res, http.StatusOK, revisions)
 }
 
 func (t *TaskResource) createTask(req *restful.Request, res *restful.Response) {
@@ -67,13 +176,17 @@ func (t *TaskResource) createTask(req *restful.Request, res *restful.Response) {
 		response.ErrorResponse(res, http.StatusBadRequest, wrap)
 		return
 	}
+	if err := types.CheckInitialStatus(task.Status); err != nil {
+		response.ErrorDetailsResponse(res, http.StatusBadRequest, err, transitionDetails(err))
+		return
+	}
 
-	task, err = db.Manager.CreateTask(task)
+	task, err = db.Manager.CreateTask(req.Request.Context(), task)
 	if err != nil {
-		response.InternalServerErrorResponse(res, err)
+		response.ServerErrorResponse(res, err)
 		return
 	}
-	t.eventNotifier <- task
+	res.AddHeader("ETag", taskETag(task))
 	response.WriteJSON(res, http.StatusCreated, task)
 }
 
@@ -92,23 +205,68 @@ func (t *TaskResource) updateTask(req *restful.Request, res *restful.Response) {
 		"path_params", req.PathParameters(),
 		"body_param", taskUp)
 
+	if !checkIfMatch(req, res, task) {
+		return
+	}
+
 	taskUp.ID = task.ID
 	taskUp.Created = task.Created
+	taskUp.Version = task.Version
 	if err := taskUp.Validate(); err != nil {
 		wrap := errors.Wrap(err, "error validating task")
 		response.ErrorResponse(res, http.StatusBadRequest, wrap)
 		return
 	}
 
-	taskUp, err = db.Manager.UpdateOneTask(taskUp)
+	// the update fails if the stored task changed since it was checked
+	if err := types.CheckTransition(task.Status, taskUp.Status); err != nil {
+		transitionConflictResponse(res, err)
+		return
+	}
+
+	taskUp, err = db.Manager.UpdateOneTask(req.Request.Context(), taskUp)
 	if err != nil {
-		response.InternalServerErrorResponse(res, err)
+		versionConflictResponse(res, err)
 		return
 	}
-	t.eventNotifier <- taskUp
+	res.AddHeader("ETag", taskETag(taskUp))
 	response.WriteJSON(res, http.StatusOK, taskUp)
 }
 
+// transitionTask returns the handler of a task action,
+// changing the task status to status
+func (t *TaskResource) transitionTask(status string) restful.RouteFunction {
+	return func(req *restful.Request, res *restful.Response) {
+		task := req.Attribute("task").(*types.Task)
+
+		log.V(10).Info(
+			"transitionTask handler",
+			"path_params", req.PathParameters(),
+			"status", status)
+
+		if !checkIfMatch(req, res, task) {
+			return
+		}
+
+		// actions are idempotent
+		if task.Status != status {
+			if err := types.CheckTransition(task.Status, status); err != nil {
+				transitionConflictResponse(res, err)
+				return
+			}
+			task.Status = status
+			var err error
+			task, err = db.Manager.UpdateOneTask(req.Request.Context(), task)
+			if err != nil {
+				versionConflictResponse(res, err)
+				return
+			}
+		}
+		res.AddHeader("ETag", taskETag(task))
+		response.WriteJSON(res, http.StatusOK, task)
+	}
+}
+
 func (t *TaskResource) deleteTask(req *restful.Request, res *restful.Response) {
 	task := req.Attribute("task").(*types.Task)
 
@@ -131,21 +289,48 @@ func (t *TaskResource) deleteTask(req *restful.Request, res *restful.Response) {
 		}
 	}
 
+	if !checkIfMatch(req, res, task) {
+		return
+	}
+
 	if permanent {
-		err = db.Manager.DeleteOneTask(task.ID)
+		err = db.Manager.DeleteOneTask(req.Request.Context(), task.ID, task.Version)
 		if err != nil {
-			response.InternalServerErrorResponse(res, err)
+			versionConflictResponse(res, err)
 			return
 		}
 	} else {
 		task.Status = types.StatusDeleted
-		task, err = db.Manager.UpdateOneTask(task)
+		task, err = db.Manager.UpdateOneTask(req.Request.Context(), task)
 		if err != nil {
-			response.InternalServerErrorResponse(res, err)
+			versionConflictResponse(res, err)
 			return
 		}
 	}
-	t.eventNotifier <- task
+	response.WriteJSON(res, http.StatusOK, task)
+}
+
+func (t *TaskResource) restoreTask(req *restful.Request, res *restful.Response) {
+	task := req.Attribute("task").(*types.Task)
+
+	log.V(10).Info(
+		"restoreTask handler",
+		"path_params", req.PathParameters())
+
+	if !checkIfMatch(req, res, task) {
+		return
+	}
+
+	task, err := db.Manager.RestoreTask(req.Request.Context(), task.ID, task.Version)
+	if errors.Cause(err) == db.ErrNotDeleted {
+		response.ErrorResponse(res, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		versionConflictResponse(res, err)
+		return
+	}
+	res.AddHeader("ETag", taskETag(task))
 	response.WriteJSON(res, http.StatusOK, task)
 }
 
@@ -160,9 +345,23 @@ func (t *TaskResource) retrieveTaskFilter(req *restful.Request, res *restful.Res
 		return
 	}
 
-	task, err := db.Manager.GetTask(id)
+	// reads can be limited to some fields
+	var fields []clauses.AllowedField
+	if req.Request.Method == http.MethodGet {
+		fields, err = clauses.FieldsFromRequest(
+			parameters.URLValuesToMap(req.Request.URL.Query()), allowedFields)
+		if err != nil {
+			response.ErrorResponse(
+				res,
+				http.StatusBadRequest,
+				err)
+			return
+		}
+	}
+
+	task, err := db.Manager.GetTask(req.Request.Context(), id, dbFields(fields)...)
 	if err != nil {
-		response.InternalServerErrorResponse(res, err)
+		response.ServerErrorResponse(res, err)
 		return
 	}
 
@@ -175,5 +374,82 @@ func (t *TaskResource) retrieveTaskFilter(req *restful.Request, res *restful.Res
 	}
 
 	req.SetAttribute("task", task)
+	req.SetAttribute("fields", fields)
 	chain.ProcessFilter(req, res)
 }
+
+// paginationLinks returns the Link header value pointing to the first,
+// previous, next and last pages of a listing, keeping other URL queries
+func paginationLinks(u *url.URL, page, pageSize, total int) string {
+	last := (total + pageSize - 1) / pageSize
+	if last < 1 {
+		last = 1
+	}
+
+	link := func(p int, rel string) string {
+		values := u.Query()
+		values.Set(clauses.PageQuery, strconv.Itoa(p))
+		values.Set(clauses.PageSizeQuery, strconv.Itoa(pageSize))
+		pu := *u
+		pu.RawQuery = values.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", pu.String(), rel)
+	}
+
+	links := []string{link(1, "first")}
+	if page > 1 {
+		prev := page - 1
+		if prev > last {
+			prev = last
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
+
+// taskETag returns the entity tag for a task version
+func taskETag(task *types.Task) string {
+	return fmt.Sprintf("%q", strconv.Itoa(task.Version))
+}
+
+// checkIfMatch compares the If-Match header with the stored task,
+// writing a precondition failed response if they don't match
+func checkIfMatch(req *restful.Request, res *restful.Response, task *types.Task) bool {
+	if parameters.IfMatch(req.HeaderParameter("If-Match"), taskETag(task)) {
+		return true
+	}
+	response.ErrorResponse(
+		res,
+		http.StatusPreconditionFailed,
+		errors.Errorf("task %d version %d doesn't match If-Match header", task.ID, task.Version))
+	return false
+}
+
+// versionConflictResponse writes a precondition failed response when the
+// task was modified concurrently, or a server error otherwise
+func versionConflictResponse(res *restful.Response, err error) {
+	if errors.Cause(err) == db.ErrVersionConflict {
+		response.ErrorResponse(res, http.StatusPreconditionFailed, err)
+		return
+	}
+	response.ServerErrorResponse(res, err)
+}
+
+// transitionConflictResponse writes a conflict response for a task
+// status that can't be changed, listing the statuses it can change to
+func transitionConflictResponse(res *restful.Response, err error) {
+	response.ErrorDetailsResponse(res, http.StatusConflict, err, transitionDetails(err))
+}
+
+// transitionDetails returns the error details of a task status
+// that can't be set, listing the allowed statuses
+func transitionDetails(err error) map[string]interface{} {
+	details := map[string]interface{}{}
+	if te, ok := errors.Cause(err).(*types.TransitionError); ok {
+		details["allowed_statuses"] = te.Allowed
+	}
+	return details
+}
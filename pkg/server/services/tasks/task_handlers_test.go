@@ -2,12 +2,13 @@ package tasks
 
 import (
 	"bytes"
-	"database/sql/driver"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"testing"
@@ -21,6 +22,7 @@ import (
 	"github.com/odacremolbap/rest-demo/pkg/db"
 	"github.com/odacremolbap/rest-demo/pkg/log"
 	"github.com/odacremolbap/rest-demo/pkg/log/dummy"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
 	"github.com/odacremolbap/rest-demo/pkg/types"
 )
 
@@ -34,6 +36,7 @@ func TestMain(m *testing.M) {
 	ws.Path("/v1").
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON)
+	restful.DefaultContainer.Filter(tenant.Filter(nil, true))
 	restful.DefaultContainer.Add(ws)
 	resource.Populate(ws)
 
@@ -45,11 +48,15 @@ func TestRetrieveTasks(t *testing.T) {
 	now := time.Now()
 
 	var testData = []struct {
-		testName         string
-		requestURL       string
-		queryError       error
-		tasks            []types.Task
-		expectedHTTPCode int
+		testName           string
+		requestURL         string
+		queryError         error
+		tasks              []types.Task
+		total              int
+		expectedHTTPCode   int
+		expectedNextCursor bool
+		expectedLink       string
+		expectedError      string
 	}{
 		{
 			testName:   "success test",
@@ -101,6 +108,128 @@ func TestRetrieveTasks(t *testing.T) {
 			},
 			expectedHTTPCode: http.StatusOK,
 		},
+		{
+			testName:   "full page test",
+			requestURL: "http://test/v1/tasks?order=name&page_size=2",
+			queryError: nil,
+			tasks: []types.Task{
+				{
+					ID:       1,
+					Name:     "name-1",
+					Category: "category-1",
+					Status:   types.StatusPending,
+					Created:  &now,
+				},
+				{
+					ID:       2,
+					Name:     "name-2",
+					Category: "category-2",
+					Status:   types.StatusPending,
+					Created:  &now,
+				},
+			},
+			expectedHTTPCode:   http.StatusOK,
+			expectedNextCursor: true,
+		},
+		{
+			testName:   "null ordered full page test",
+			requestURL: "http://test/v1/tasks?order=due_date:desc:nullslast&page_size=2",
+			queryError: nil,
+			tasks: []types.Task{
+				{
+					ID:       1,
+					Name:     "name-1",
+					Category: "category-1",
+					Status:   types.StatusPending,
+					DueDate:  &now,
+					Created:  &now,
+				},
+				{
+					ID:       2,
+					Name:     "name-2",
+					Category: "category-2",
+					Status:   types.StatusPending,
+					Created:  &now,
+				},
+			},
+			expectedHTTPCode:   http.StatusOK,
+			expectedNextCursor: true,
+		},
+		{
+			testName:         "bad order modifier test",
+			requestURL:       "http://test/v1/tasks?order=due_date:nullslast:desc",
+			queryError:       nil,
+			tasks:            []types.Task{},
+			expectedHTTPCode: http.StatusBadRequest,
+			expectedError:    "ordering clause due_date has wrong modifier desc",
+		},
+		{
+			testName:   "page links test",
+			requestURL: "http://test/v1/tasks?status=pending&page=2&page_size=1",
+			queryError: nil,
+			tasks: []types.Task{
+				{
+					ID:       2,
+					Name:     "name-2",
+					Category: "category-2",
+					Status:   types.StatusPending,
+					Created:  &now,
+				},
+			},
+			total:              3,
+			expectedHTTPCode:   http.StatusOK,
+			expectedNextCursor: true,
+			expectedLink: `<http://test/v1/tasks?page=1&page_size=1&status=pending>; rel="first", ` +
+				`<http://test/v1/tasks?page=1&page_size=1&status=pending>; rel="prev", ` +
+				`<http://test/v1/tasks?page=3&page_size=1&status=pending>; rel="next", ` +
+				`<http://test/v1/tasks?page=3&page_size=1&status=pending>; rel="last"`,
+		},
+		{
+			testName:         "bad cursor test",
+			requestURL:       "http://test/v1/tasks?cursor=wrong",
+			queryError:       nil,
+			tasks:            []types.Task{},
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+		{
+			testName:   "search test",
+			requestURL: "http://test/v1/tasks?q=name&status=pending",
+			queryError: nil,
+			tasks: []types.Task{
+				{
+					ID:          1,
+					Name:        "name-1",
+					Description: "description-1",
+					Category:    "category-1",
+					Status:      types.StatusPending,
+					Created:     &now,
+				},
+			},
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName:   "filter expression test",
+			requestURL: "http://test/v1/tasks?filter=" + url.QueryEscape("(status==pending,status==started);category!=archive"),
+			queryError: nil,
+			tasks: []types.Task{
+				{
+					ID:       1,
+					Name:     "name-1",
+					Category: "category-1",
+					Status:   types.StatusStarted,
+					Created:  &now,
+				},
+			},
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName:         "bad filter expression test",
+			requestURL:       "http://test/v1/tasks?filter=" + url.QueryEscape("status==pending;category=gt=a"),
+			queryError:       nil,
+			tasks:            []types.Task{},
+			expectedHTTPCode: http.StatusBadRequest,
+			expectedError:    "operator gt is not allowed for field category at position 25",
+		},
 		{
 			testName:         "bad request test",
 			requestURL:       "http://test/v1/tasks?id=noninteger",
@@ -125,7 +254,7 @@ func TestRetrieveTasks(t *testing.T) {
 		db.Manager = db.NewTODOPersistenceManager(fakeDB)
 
 		filledRows := sqlmock.NewRows([]string{
-			"id", "name", "description", "category", "status", "duedate", "created"})
+			"id", "name", "description", "category", "status", "duedate", "created", "version"})
 		for _, task := range td.tasks {
 			filledRows.AddRow(
 				task.ID,
@@ -134,7 +263,8 @@ func TestRetrieveTasks(t *testing.T) {
 				task.Category,
 				task.Status,
 				task.DueDate,
-				task.Created)
+				task.Created,
+				task.Version)
 		}
 
 		mock.ExpectPrepare(`^(\s*)select(.*)from tasks(.*)$`).
@@ -142,6 +272,14 @@ func TestRetrieveTasks(t *testing.T) {
 			WillReturnRows(filledRows).
 			WillReturnError(td.queryError)
 
+		total := td.total
+		if total == 0 {
+			total = len(td.tasks)
+		}
+		mock.ExpectPrepare(`^select count\(\*\) from tasks(.*)$`).
+			ExpectQuery().
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+
 		res := httptest.NewRecorder()
 		req, err := http.NewRequest("GET", td.requestURL, nil)
 		require.Nil(t, err, "%q - creating request", td.testName)
@@ -159,10 +297,32 @@ func TestRetrieveTasks(t *testing.T) {
 		}
 
 		if res.Code != http.StatusOK {
+			if td.expectedError != "" {
+				b, _ := ioutil.ReadAll(res.Body)
+				assert.Contains(t, string(b), td.expectedError, "%q - error message", td.testName)
+			}
 			// move on, this test expects no tasks
 			continue
 		}
 
+		assert.Equal(t,
+			td.expectedNextCursor,
+			res.Header().Get("X-Next-Cursor") != "",
+			"%q - next cursor header",
+			td.testName)
+		assert.Equal(t,
+			strconv.Itoa(total),
+			res.Header().Get("X-Total-Count"),
+			"%q - total count header",
+			td.testName)
+		if td.expectedLink != "" {
+			assert.Equal(t,
+				td.expectedLink,
+				res.Header().Get("Link"),
+				"%q - link header",
+				td.testName)
+		}
+
 		d := json.NewDecoder(res.Body)
 		tasks := []types.Task{}
 		err = d.Decode(&tasks)
@@ -217,6 +377,7 @@ func TestGetOneTask(t *testing.T) {
 				Category:    "category-1",
 				Status:      types.StatusStarted,
 				Created:     &now,
+				Version:     3,
 			},
 			expectedHTTPCode: http.StatusOK,
 		},
@@ -251,7 +412,7 @@ func TestGetOneTask(t *testing.T) {
 		db.Manager = db.NewTODOPersistenceManager(fakeDB)
 
 		filledRows := sqlmock.NewRows([]string{
-			"name", "description", "category", "status", "duedate", "created"})
+			"name", "description", "category", "status", "duedate", "created", "version"})
 		if td.task != nil {
 			filledRows.AddRow(
 				td.task.Name,
@@ -259,7 +420,8 @@ func TestGetOneTask(t *testing.T) {
 				td.task.Category,
 				td.task.Status,
 				td.task.DueDate,
-				td.task.Created)
+				td.task.Created,
+				td.task.Version)
 		}
 
 		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
@@ -283,6 +445,13 @@ func TestGetOneTask(t *testing.T) {
 			continue
 		}
 
+		if res.Code == http.StatusOK {
+			assert.Equal(t,
+				fmt.Sprintf("%q", strconv.Itoa(td.task.Version)),
+				res.Header().Get("ETag"),
+				"%q - wrong ETag", td.testName)
+		}
+
 		d := json.NewDecoder(res.Body)
 		task := types.Task{}
 		err = d.Decode(&task)
@@ -345,6 +514,17 @@ func TestCreateTask(t *testing.T) {
 			insertQueryError: nil,
 			expectedHTTPCode: http.StatusBadRequest,
 		},
+		{
+			testName:   "deleted status test",
+			newID:      1,
+			newCreated: &now,
+			newTask: &types.Task{
+				Name:   "name-1",
+				Status: types.StatusDeleted,
+			},
+			insertQueryError: nil,
+			expectedHTTPCode: http.StatusBadRequest,
+		},
 		{
 			testName:         "bad request test",
 			newID:            1,
@@ -375,16 +555,19 @@ func TestCreateTask(t *testing.T) {
 		defer fakeDB.Close()
 		db.Manager = db.NewTODOPersistenceManager(fakeDB)
 
-		filledRows := sqlmock.NewRows([]string{"id", "created"})
+		filledRows := sqlmock.NewRows([]string{"id", "created", "version"})
 
 		filledRows.AddRow(
 			td.newID,
-			td.newCreated)
+			td.newCreated,
+			1)
 
+		mock.ExpectBegin()
 		mock.ExpectPrepare(`^(\s*)insert into tasks(.*)values(.*)returning(.*)$`).
 			ExpectQuery().
 			WillReturnRows(filledRows).
 			WillReturnError(td.insertQueryError)
+		expectRevision(mock)
 
 		b, err := json.Marshal(td.newTask)
 		require.Nil(t, err, "marshaling task")
@@ -442,8 +625,11 @@ func TestUpdateTask(t *testing.T) {
 		existsTask       *types.Task
 		id               string
 		task             *types.Task
+		ifMatch          string
 		updateQueryError error
+		updatedRows      int64
 		expectedHTTPCode int
+		expectedError    string
 	}{
 		{
 			testName:         "success test",
@@ -467,8 +653,86 @@ func TestUpdateTask(t *testing.T) {
 				Created:     &now,
 			},
 			updateQueryError: nil,
+			updatedRows:      1,
 			expectedHTTPCode: http.StatusOK,
 		},
+		{
+			testName:         "if-match success test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:          1,
+				Name:        "name-1",
+				Description: "description-1",
+				Category:    "c1",
+				Status:      types.StatusPending,
+				Created:     &now,
+				Version:     2,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:          1,
+				Name:        "name-1-new",
+				Description: "description-1-new",
+				Category:    "c1-new",
+				Status:      types.StatusPending,
+				Created:     &now,
+			},
+			ifMatch:          `"1", "2"`,
+			updateQueryError: nil,
+			updatedRows:      1,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName:         "if-match failed test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:          1,
+				Name:        "name-1",
+				Description: "description-1",
+				Category:    "c1",
+				Status:      types.StatusPending,
+				Created:     &now,
+				Version:     2,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:          1,
+				Name:        "name-1-new",
+				Description: "description-1-new",
+				Category:    "c1-new",
+				Status:      types.StatusPending,
+				Created:     &now,
+			},
+			ifMatch:          `"1"`,
+			updateQueryError: nil,
+			updatedRows:      1,
+			expectedHTTPCode: http.StatusPreconditionFailed,
+		},
+		{
+			testName:         "concurrent update test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:          1,
+				Name:        "name-1",
+				Description: "description-1",
+				Category:    "c1",
+				Status:      types.StatusPending,
+				Created:     &now,
+				Version:     2,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:          1,
+				Name:        "name-1-new",
+				Description: "description-1-new",
+				Category:    "c1-new",
+				Status:      types.StatusPending,
+				Created:     &now,
+			},
+			updateQueryError: nil,
+			updatedRows:      0,
+			expectedHTTPCode: http.StatusPreconditionFailed,
+		},
 		{
 			testName:         "update db fail test",
 			existsQueryError: nil,
@@ -515,6 +779,125 @@ func TestUpdateTask(t *testing.T) {
 			updateQueryError: nil,
 			expectedHTTPCode: http.StatusBadRequest,
 		},
+		{
+			testName:         "status transition test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusFinished,
+				Created: &now,
+			},
+			updateQueryError: nil,
+			updatedRows:      1,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName:         "finished to pending conflict test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusFinished,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+			},
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are [canceled]",
+		},
+		{
+			testName:         "finished to started conflict test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusFinished,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+			},
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are [canceled]",
+		},
+		{
+			testName:         "started to pending conflict test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+			},
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are [finished canceled]",
+		},
+		{
+			testName:         "set deleted conflict test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusDeleted,
+				Created: &now,
+			},
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "Task status can't change from pending to deleted",
+		},
+		{
+			testName:         "update deleted conflict test",
+			existsQueryError: nil,
+			existsTask: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusDeleted,
+				Created: &now,
+			},
+			id: "1",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1-new",
+				Created: &now,
+			},
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are []",
+		},
 		{
 			testName:         "task does not exists test",
 			existsQueryError: nil,
@@ -542,7 +925,7 @@ func TestUpdateTask(t *testing.T) {
 
 		// First query is checking if the task exists
 		existsRows := sqlmock.NewRows([]string{
-			"name", "description", "catgory", "status", "duedate", "created"})
+			"name", "description", "catgory", "status", "duedate", "created", "version"})
 		if td.existsTask != nil {
 			existsRows.AddRow(
 				td.existsTask.Name,
@@ -550,7 +933,8 @@ func TestUpdateTask(t *testing.T) {
 				td.existsTask.Category,
 				td.existsTask.Status,
 				td.existsTask.DueDate,
-				td.existsTask.Created)
+				td.existsTask.Created,
+				td.existsTask.Version)
 		}
 
 		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
@@ -558,11 +942,17 @@ func TestUpdateTask(t *testing.T) {
 			WillReturnRows(existsRows).
 			WillReturnError(td.existsQueryError)
 
-		// Second command is updating the record
+		// Second command is updating the record, reading it
+		// again in the same transaction to record the revision
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(td.existsTask))
 		mock.ExpectPrepare(`^(\s*)update tasks set(.*)where id =(.*)$`).
 			ExpectExec().
-			WillReturnResult(driver.ResultNoRows).
+			WillReturnResult(sqlmock.NewResult(0, td.updatedRows)).
 			WillReturnError(td.updateQueryError)
+		expectRevision(mock)
 
 		b, err := json.Marshal(td.task)
 		require.Nil(t, err, "marshaling task")
@@ -576,6 +966,9 @@ func TestUpdateTask(t *testing.T) {
 		require.Nil(t, err)
 
 		req.Header.Add("Content-Type", "application/json;charset=utf-8")
+		if td.ifMatch != "" {
+			req.Header.Add("If-Match", td.ifMatch)
+		}
 		restful.DefaultContainer.ServeHTTP(res, req)
 
 		if !assert.Equal(t,
@@ -587,6 +980,11 @@ func TestUpdateTask(t *testing.T) {
 			continue
 		}
 
+		if td.expectedError != "" {
+			b, _ := ioutil.ReadAll(res.Body)
+			assert.Contains(t, string(b), td.expectedError, "%q - error message", td.testName)
+		}
+
 		if res.Code != http.StatusCreated {
 			// move on, this test expects no task
 			continue
@@ -618,6 +1016,7 @@ func TestDeleteTask(t *testing.T) {
 		permanent        string
 		id               string
 		task             *types.Task
+		ifMatch          string
 		existsQueryError error
 		deleteQueryError error
 		updateQueryError error
@@ -674,6 +1073,25 @@ func TestDeleteTask(t *testing.T) {
 			updateQueryError: nil,
 			expectedHTTPCode: http.StatusBadRequest,
 		},
+		{
+			testName:  "if-match failed test",
+			permanent: "true",
+			id:        "1",
+			task: &types.Task{
+				ID:          1,
+				Name:        "name-1-new",
+				Description: "description-1-new",
+				Category:    "c1-new",
+				Status:      types.StatusStarted,
+				Created:     &now,
+				Version:     4,
+			},
+			ifMatch:          `"3"`,
+			existsQueryError: nil,
+			deleteQueryError: nil,
+			updateQueryError: nil,
+			expectedHTTPCode: http.StatusPreconditionFailed,
+		},
 		// {
 		// 	testName: "task does not exists test",
 		// },
@@ -688,7 +1106,7 @@ func TestDeleteTask(t *testing.T) {
 
 		// First query is checking if the task exists
 		existsRows := sqlmock.NewRows([]string{
-			"name", "description", "catgory", "status", "duedate", "created"})
+			"name", "description", "catgory", "status", "duedate", "created", "version"})
 		if td.task != nil {
 			existsRows.AddRow(
 				td.task.Name,
@@ -696,7 +1114,8 @@ func TestDeleteTask(t *testing.T) {
 				td.task.Category,
 				td.task.Status,
 				td.task.DueDate,
-				td.task.Created)
+				td.task.Created,
+				td.task.Version)
 		}
 
 		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
@@ -709,19 +1128,24 @@ func TestDeleteTask(t *testing.T) {
 		if td.permanent != "" {
 			url = fmt.Sprintf("%s?permanent=%s", url, td.permanent)
 		}
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(td.task))
 		if permanent {
 			// If permanent, second command is deleting
 			mock.ExpectPrepare(`^(\s*)delete from tasks where id =(.*)$`).
 				ExpectExec().
-				WillReturnResult(driver.ResultNoRows).
+				WillReturnResult(sqlmock.NewResult(0, 1)).
 				WillReturnError(td.deleteQueryError)
 		} else {
 			// If not permanent third query is updating the status field
 			mock.ExpectPrepare(`^(\s*)update tasks set(.*)where id =(.*)$`).
 				ExpectExec().
-				WillReturnResult(driver.ResultNoRows).
+				WillReturnResult(sqlmock.NewResult(0, 1)).
 				WillReturnError(td.updateQueryError)
 		}
+		expectRevision(mock)
 
 		b, err := json.Marshal(td.task)
 		require.Nil(t, err, "marshaling task")
@@ -735,6 +1159,9 @@ func TestDeleteTask(t *testing.T) {
 		require.Nil(t, err)
 
 		req.Header.Add("Content-Type", "application/json;charset=utf-8")
+		if td.ifMatch != "" {
+			req.Header.Add("If-Match", td.ifMatch)
+		}
 		restful.DefaultContainer.ServeHTTP(res, req)
 
 		if !assert.Equal(t,
@@ -768,3 +1195,463 @@ func TestDeleteTask(t *testing.T) {
 		}
 	}
 }
+
+func TestRestoreTask(t *testing.T) {
+	now := time.Now()
+
+	var testData = []struct {
+		testName         string
+		task             *types.Task
+		ifMatch          string
+		expectedStatus   string
+		expectedHTTPCode int
+	}{
+		{
+			testName: "success test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusDeleted,
+				Created: &now,
+				Version: 2,
+			},
+			expectedStatus:   types.StatusStarted,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName: "not deleted test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+				Version: 2,
+			},
+			expectedHTTPCode: http.StatusConflict,
+		},
+		{
+			testName: "if-match failed test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusDeleted,
+				Created: &now,
+				Version: 2,
+			},
+			ifMatch:          `"1"`,
+			expectedHTTPCode: http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, td := range testData {
+		fakeDB, mock, err := sqlmock.New()
+		require.Nil(t, err, "%q - opening mock database", td.testName)
+		defer fakeDB.Close()
+		db.Manager = db.NewTODOPersistenceManager(fakeDB)
+
+		// task retrieved by the filter, then read again at the transaction
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(td.task))
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(td.task))
+		mock.ExpectPrepare(`^(\s*)update tasks set(\s*)status = coalesce\(previous_status, 'pending'\)(.*)$`).
+			ExpectExec().
+			WithArgs(td.task.ID, td.task.Version, tenant.Default).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		restored := *td.task
+		restored.Status = td.expectedStatus
+		restored.Version++
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(&restored))
+		expectRevision(mock)
+
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest(
+			"POST",
+			fmt.Sprintf("http://test/v1/tasks/%d/restore", td.task.ID),
+			nil)
+		require.Nil(t, err)
+		if td.ifMatch != "" {
+			req.Header.Add("If-Match", td.ifMatch)
+		}
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - HTTP status", td.testName) {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Log(string(b))
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+
+		task := types.Task{}
+		err = json.NewDecoder(res.Body).Decode(&task)
+		if !assert.Nil(t, err, "%q - decoding task failed", td.testName) {
+			continue
+		}
+		assert.Equal(t, td.expectedStatus, task.Status, "%q - restored status", td.testName)
+		assert.Equal(t, td.task.Version+1, task.Version, "%q - restored version", td.testName)
+		assert.Nil(t, mock.ExpectationsWereMet(), "%q - database expectations", td.testName)
+	}
+}
+
+func TestTaskActions(t *testing.T) {
+	now := time.Now()
+
+	var testData = []struct {
+		testName         string
+		task             *types.Task
+		action           string
+		ifMatch          string
+		expectedStatus   string
+		expectedHTTPCode int
+		expectedError    string
+	}{
+		{
+			testName: "start test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "start",
+			expectedStatus:   types.StatusStarted,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName: "finish test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "finish",
+			expectedStatus:   types.StatusFinished,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName: "already started test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusStarted,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "start",
+			expectedStatus:   types.StatusStarted,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName: "reopen canceled test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusCanceled,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "reopen",
+			expectedStatus:   types.StatusPending,
+			expectedHTTPCode: http.StatusOK,
+		},
+		{
+			testName: "reopen finished conflict test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusFinished,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "reopen",
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are [canceled]",
+		},
+		{
+			testName: "start deleted conflict test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusDeleted,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "start",
+			expectedHTTPCode: http.StatusConflict,
+			expectedError:    "allowed statuses are []",
+		},
+		{
+			testName: "if-match failed test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "start",
+			ifMatch:          `"1"`,
+			expectedHTTPCode: http.StatusPreconditionFailed,
+		},
+		{
+			testName: "unknown action test",
+			task: &types.Task{
+				ID:      1,
+				Name:    "name-1",
+				Status:  types.StatusPending,
+				Created: &now,
+				Version: 2,
+			},
+			action:           "pause",
+			expectedHTTPCode: http.StatusNotFound,
+		},
+	}
+
+	for _, td := range testData {
+		fakeDB, mock, err := sqlmock.New()
+		require.Nil(t, err, "%q - opening mock database", td.testName)
+		defer fakeDB.Close()
+		db.Manager = db.NewTODOPersistenceManager(fakeDB)
+
+		// task retrieved by the filter, then read again at the transaction
+		mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+			ExpectQuery().
+			WillReturnRows(taskRows(td.task))
+		changes := td.expectedHTTPCode == http.StatusOK && td.task.Status != td.expectedStatus
+		if changes {
+			mock.ExpectBegin()
+			mock.ExpectPrepare(`^(\s*)select(.*)from tasks where id = \$1(.*)$`).
+				ExpectQuery().
+				WillReturnRows(taskRows(td.task))
+			mock.ExpectPrepare(`^(\s*)update tasks set(.*)where id =(.*)$`).
+				ExpectExec().
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectRevision(mock)
+		}
+
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest(
+			"POST",
+			fmt.Sprintf("http://test/v1/tasks/%d/%s", td.task.ID, td.action),
+			nil)
+		require.Nil(t, err)
+		if td.ifMatch != "" {
+			req.Header.Add("If-Match", td.ifMatch)
+		}
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - HTTP status", td.testName) {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Log(string(b))
+			continue
+		}
+		if res.Code != http.StatusOK {
+			if td.expectedError != "" {
+				b, _ := ioutil.ReadAll(res.Body)
+				assert.Contains(t, string(b), td.expectedError, "%q - error message", td.testName)
+			}
+			continue
+		}
+
+		task := types.Task{}
+		err = json.NewDecoder(res.Body).Decode(&task)
+		if !assert.Nil(t, err, "%q - decoding task failed", td.testName) {
+			continue
+		}
+		assert.Equal(t, td.expectedStatus, task.Status, "%q - status", td.testName)
+		if changes {
+			assert.Equal(t, td.task.Version+1, task.Version, "%q - version", td.testName)
+		}
+		assert.Nil(t, mock.ExpectationsWereMet(), "%q - database expectations", td.testName)
+	}
+}
+
+func TestTaskHistory(t *testing.T) {
+	store := db.NewMemoryPersistenceManager()
+	db.Manager = store
+	ctx := tenant.NewContext(context.Background(), "team-a")
+
+	task, err := store.CreateTask(ctx, &types.Task{Name: "name-1", Status: types.StatusPending})
+	require.Nil(t, err, "creating task")
+	task.Status = types.StatusStarted
+	_, err = store.UpdateOneTask(ctx, task)
+	require.Nil(t, err, "updating task")
+	require.Nil(t, store.DeleteOneTask(ctx, task.ID, task.Version), "deleting task")
+
+	var testData = []struct {
+		testName           string
+		requestURL         string
+		tenant             string
+		expectedHTTPCode   int
+		expectedOperations []string
+	}{
+		{
+			testName:           "success test",
+			requestURL:         fmt.Sprintf("http://test/v1/tasks/%d/history", task.ID),
+			expectedHTTPCode:   http.StatusOK,
+			expectedOperations: []string{types.OperationCreate, types.OperationUpdate, types.OperationDelete},
+		},
+		{
+			testName:           "pagination test",
+			requestURL:         fmt.Sprintf("http://test/v1/tasks/%d/history?page=2&page_size=2", task.ID),
+			expectedHTTPCode:   http.StatusOK,
+			expectedOperations: []string{types.OperationDelete},
+		},
+		{
+			testName:           "other tenant test",
+			requestURL:         fmt.Sprintf("http://test/v1/tasks/%d/history", task.ID),
+			tenant:             "team-b",
+			expectedHTTPCode:   http.StatusOK,
+			expectedOperations: []string{},
+		},
+		{
+			testName:           "unknown task test",
+			requestURL:         "http://test/v1/tasks/1000/history",
+			expectedHTTPCode:   http.StatusOK,
+			expectedOperations: []string{},
+		},
+		{
+			testName:         "bad request test",
+			requestURL:       "http://test/v1/tasks/not-an-integer/history",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, td := range testData {
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", td.requestURL, nil)
+		require.Nil(t, err, "%q - creating request", td.testName)
+		if td.tenant == "" {
+			td.tenant = "team-a"
+		}
+		req.Header.Set(tenant.Header, td.tenant)
+
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - wrong HTTP status code",
+			td.testName) || res.Code != http.StatusOK {
+			continue
+		}
+
+		revisions := []types.TaskRevision{}
+		err = json.NewDecoder(res.Body).Decode(&revisions)
+		if !assert.Nil(t, err, "%q - decoding revisions", td.testName) {
+			continue
+		}
+		operations := []string{}
+		for _, r := range revisions {
+			operations = append(operations, r.Operation)
+		}
+		assert.Equal(t, td.expectedOperations, operations, "%q - wrong revisions", td.testName)
+	}
+}
+
+// taskRows returns the mocked rows for a single task query
+func taskRows(task *types.Task) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{
+		"name", "description", "category", "status", "duedate", "created", "version"})
+	if task != nil {
+		rows.AddRow(
+			task.Name,
+			task.Description,
+			task.Category,
+			task.Status,
+			task.DueDate,
+			task.Created,
+			task.Version)
+	}
+	return rows
+}
+
+// expectRevision mocks recording a task revision, notifying the change and committing
+func expectRevision(mock sqlmock.Sqlmock) {
+	mock.ExpectPrepare(`^(\s*)insert into task_revisions(.*)values(.*)$`).
+		ExpectExec().
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`^(\s*)insert into task_events(.*)values(.*)$`).
+		WithArgs("default", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`^select pg_notify\(\$1, ''\)$`).
+		WithArgs("task_events").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	fakeDB, mock, err := sqlmock.New()
+	require.Nil(t, err, "opening mock database")
+	defer fakeDB.Close()
+	pm := db.NewTODOPersistenceManager(fakeDB)
+	pm.SetQueryTimeout(10 * time.Millisecond)
+	db.Manager = pm
+
+	mock.ExpectPrepare(`^(\s*)select(.*)from tasks(.*)$`).
+		ExpectQuery().
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://test/v1/tasks", nil)
+	require.Nil(t, err, "creating request")
+
+	restful.DefaultContainer.ServeHTTP(res, req)
+
+	if !assert.Equal(t, http.StatusGatewayTimeout, res.Code, "wrong HTTP status code") {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Log(string(b))
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	store := db.NewMemoryPersistenceManager()
+	db.Manager = store
+
+	task, err := store.CreateTask(
+		tenant.NewContext(context.Background(), "team-a"),
+		&types.Task{Name: "name-1", Status: types.StatusPending})
+	require.Nil(t, err, "creating task")
+
+	var testData = []struct {
+		testName         string
+		tenant           string
+		expectedHTTPCode int
+	}{
+		{"own tenant test", "team-a", http.StatusOK},
+		{"other tenant test", "team-b", http.StatusNotFound},
+		{"default tenant test", "", http.StatusNotFound},
+	}
+
+	for _, td := range testData {
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://test/v1/tasks/%d", task.ID), nil)
+		require.Nil(t, err, "%q - creating request", td.testName)
+		req.Header.Set(tenant.Header, td.tenant)
+
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - wrong HTTP status code",
+			td.testName)
+	}
+}
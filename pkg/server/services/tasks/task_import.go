@@ -0,0 +1,229 @@
+package tasks
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/server/response"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// import formats
+const (
+	mimeNDJSON = "application/x-ndjson"
+	mimeCSV    = "text/csv"
+)
+
+const (
+	// importMaxLines limits the lines of an import request
+	importMaxLines = 10000
+	// importMaxLineSize limits the size of a NDJSON line
+	importMaxLineSize = 64 * 1024
+	// importMaxBytes limits the size of an import request body
+	importMaxBytes = 16 * 1024 * 1024
+)
+
+// errImportTooLarge is returned reading import request bodies over importMaxBytes
+var errImportTooLarge = errors.Errorf("imports are limited to %d bytes", importMaxBytes)
+
+// bodyLimiter reads a request body, failing with errImportTooLarge
+// once more than limit bytes have been read
+type bodyLimiter struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (b *bodyLimiter) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return 0, errImportTooLarge
+	}
+	return n, err
+}
+
+// importColumns maps CSV header columns to task fields
+var importColumns = map[string]func(t *types.Task, value string) error{
+	"name":        func(t *types.Task, v string) error { t.Name = v; return nil },
+	"description": func(t *types.Task, v string) error { t.Description = v; return nil },
+	"category":    func(t *types.Task, v string) error { t.Category = v; return nil },
+	"status":      func(t *types.Task, v string) error { t.Status = v; return nil },
+	"due_date": func(t *types.Task, v string) error {
+		if v == "" {
+			return nil
+		}
+		d, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return errors.Wrap(err, "error parsing due_date")
+		}
+		t.DueDate = &d
+		return nil
+	},
+}
+
+// importLine is a parsed line of an import request, holding
+// a task or the reason it was rejected
+type importLine struct {
+	line int
+	task *types.Task
+	err  error
+}
+
+func (t *TaskResource) importTasks(req *restful.Request, res *restful.Response) {
+	log.V(10).Info("importTasks handler", "content_type", req.HeaderParameter("Content-Type"))
+
+	mediaType, _, err := mime.ParseMediaType(req.HeaderParameter("Content-Type"))
+	if err != nil {
+		response.ErrorResponse(res, http.StatusUnsupportedMediaType, errors.Wrap(err, "error parsing content type"))
+		return
+	}
+
+	body := &bodyLimiter{r: req.Request.Body, limit: importMaxBytes}
+	var lines []importLine
+	switch mediaType {
+	case mimeNDJSON:
+		lines, err = parseNDJSON(body)
+	case mimeCSV:
+		lines, err = parseCSV(body)
+	default:
+		err = errors.Errorf("content type must be one of %s|%s", mimeNDJSON, mimeCSV)
+		response.ErrorResponse(res, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	if errors.Cause(err) == errImportTooLarge {
+		response.ErrorResponse(res, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		response.ErrorResponse(res, http.StatusBadRequest, err)
+		return
+	}
+
+	tasks := []*types.Task{}
+	for i := range lines {
+		l := &lines[i]
+		if l.err == nil {
+			l.err = l.task.Validate()
+		}
+		if l.err == nil {
+			l.err = types.CheckInitialStatus(l.task.Status)
+		}
+		if l.err == nil {
+			tasks = append(tasks, l.task)
+		}
+	}
+
+	if err = db.Manager.ImportTasks(req.Request.Context(), tasks); err != nil {
+		response.ServerErrorResponse(res, err)
+		return
+	}
+
+	report := types.TaskImportReport{Lines: []types.TaskImportLine{}}
+	for _, l := range lines {
+		if l.err != nil {
+			report.Rejected++
+			report.Lines = append(report.Lines, types.TaskImportLine{Line: l.line, Error: l.err.Error()})
+			continue
+		}
+		report.Accepted++
+		report.Lines = append(report.Lines, types.TaskImportLine{Line: l.line, Accepted: true, ID: l.task.ID})
+	}
+	response.WriteJSON(res, http.StatusOK, report)
+}
+
+// parseNDJSON reads a task per line, skipping blank lines
+func parseNDJSON(r io.Reader) ([]importLine, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), importMaxLineSize)
+
+	lines := []importLine{}
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(lines) == importMaxLines {
+			return nil, errors.Errorf("imports are limited to %d tasks", importMaxLines)
+		}
+
+		task := &types.Task{}
+		err := json.Unmarshal([]byte(text), task)
+		if err != nil {
+			err = errors.Wrap(err, "error parsing task")
+		}
+		lines = append(lines, importLine{line: n, task: task, err: err})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading tasks")
+	}
+	return lines, nil
+}
+
+// parseCSV reads a task per record. The first record is a header
+// naming the task field at each column
+func parseCSV(r io.Reader) ([]importLine, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing CSV header")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CSV header")
+	}
+	setters := make([]func(*types.Task, string) error, len(header))
+	for i, column := range header {
+		setter, ok := importColumns[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			return nil, errors.Errorf("unknown CSV column %q", column)
+		}
+		setters[i] = setter
+	}
+
+	lines := []importLine{}
+	for n := 2; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(lines) == importMaxLines {
+			return nil, errors.Errorf("imports are limited to %d tasks", importMaxLines)
+		}
+		if err != nil {
+			perr, ok := err.(*csv.ParseError)
+			if !ok {
+				return nil, errors.Wrap(err, "error reading tasks")
+			}
+			n = perr.Line
+			lines = append(lines, importLine{line: n, err: errors.Wrap(err, "error parsing task")})
+			continue
+		}
+		if len(record) != len(header) {
+			lines = append(lines, importLine{line: n, err: errors.Errorf(
+				"got %d fields, header has %d", len(record), len(header))})
+			continue
+		}
+
+		task := &types.Task{}
+		for i, value := range record {
+			if err = setters[i](task, value); err != nil {
+				break
+			}
+		}
+		lines = append(lines, importLine{line: n, task: task, err: err})
+	}
+	return lines, nil
+}
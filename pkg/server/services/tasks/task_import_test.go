@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+func TestImportTasks(t *testing.T) {
+	var testData = []struct {
+		testName         string
+		contentType      string
+		body             string
+		expectedHTTPCode int
+		expectedLines    []types.TaskImportLine
+	}{
+		{
+			testName:    "ndjson test",
+			contentType: "application/x-ndjson",
+			body: `{"name": "a", "status": "started"}
+
+{"name": "b", "status": "unknown"}
+{"name":
+{"name": "c", "due_date": "2030-01-02T15:04:05Z"}
+{"name": "d", "status": "deleted"}
+`,
+			expectedHTTPCode: http.StatusOK,
+			expectedLines: []types.TaskImportLine{
+				{Line: 1, Accepted: true, ID: 1},
+				{Line: 3},
+				{Line: 4},
+				{Line: 5, Accepted: true, ID: 2},
+				{Line: 6},
+			},
+		},
+		{
+			testName:    "csv test",
+			contentType: "text/csv; charset=utf-8",
+			body: `name,category,status,due_date
+a,home,pending,
+,home,pending,
+b,"work, office",finished,2030-01-02T15:04:05Z
+c,home,pending,tomorrow
+`,
+			expectedHTTPCode: http.StatusOK,
+			expectedLines: []types.TaskImportLine{
+				{Line: 2, Accepted: true, ID: 1},
+				{Line: 3},
+				{Line: 4, Accepted: true, ID: 2},
+				{Line: 5},
+			},
+		},
+		{
+			testName:         "csv unknown column test",
+			contentType:      "text/csv",
+			body:             "name,owner\na,me\n",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+		{
+			testName:         "csv too large test",
+			contentType:      "text/csv",
+			body:             "name\n" + strings.Repeat("a", importMaxBytes),
+			expectedHTTPCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			testName:         "ndjson too large test",
+			contentType:      "application/x-ndjson",
+			body:             strings.Repeat(`{"name": "`+strings.Repeat("a", 4096)+`"}`+"\n", importMaxBytes/4096),
+			expectedHTTPCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			testName:         "unsupported content type test",
+			contentType:      "application/json",
+			body:             `[{"name": "a"}]`,
+			expectedHTTPCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, td := range testData {
+		db.Manager = db.NewMemoryPersistenceManager()
+
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest(
+			"POST",
+			"http://test/v1/tasks:import",
+			bytes.NewBufferString(td.body))
+		require.Nil(t, err)
+		req.Header.Add("Content-Type", td.contentType)
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - HTTP status", td.testName) {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Log(string(b))
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+
+		report := types.TaskImportReport{}
+		err = json.NewDecoder(res.Body).Decode(&report)
+		if !assert.Nil(t, err, "%q - decoding report failed", td.testName) ||
+			!assert.Equal(t, len(td.expectedLines), len(report.Lines), "%q - report lines", td.testName) {
+			continue
+		}
+		accepted := 0
+		for i, expected := range td.expectedLines {
+			line := report.Lines[i]
+			assert.Equal(t, expected.Line, line.Line, "%q - line number", td.testName)
+			assert.Equal(t, expected.Accepted, line.Accepted, "%q - line %d accepted", td.testName, line.Line)
+			assert.Equal(t, expected.ID, line.ID, "%q - line %d ID", td.testName, line.Line)
+			assert.Equal(t, expected.Accepted, line.Error == "", "%q - line %d error %q", td.testName, line.Line, line.Error)
+			if expected.Accepted {
+				accepted++
+			}
+		}
+		assert.Equal(t, accepted, report.Accepted, "%q - accepted count", td.testName)
+		assert.Equal(t, len(td.expectedLines)-accepted, report.Rejected, "%q - rejected count", td.testName)
+	}
+}
+
+func TestBodyLimiter(t *testing.T) {
+	b, err := ioutil.ReadAll(&bodyLimiter{r: strings.NewReader("abcd"), limit: 4})
+	assert.Nil(t, err, "body at the limit")
+	assert.Equal(t, "abcd", string(b), "body at the limit")
+
+	_, err = ioutil.ReadAll(&bodyLimiter{r: strings.NewReader("abcde"), limit: 4})
+	assert.Equal(t, errImportTooLarge, err, "body over the limit")
+}
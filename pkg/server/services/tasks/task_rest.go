@@ -7,26 +7,38 @@ import (
 	restful "github.com/emicklei/go-restful"
 	restfulspec "github.com/emicklei/go-restful-openapi"
 
+	"github.com/odacremolbap/rest-demo/pkg/db"
 	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
 	"github.com/odacremolbap/rest-demo/pkg/types"
 )
 
 // TaskResource REST layer
 type TaskResource struct {
-	eventNotifier      chan interface{}
-	registerWatcher    chan chan interface{}
+	events             <-chan types.TaskEvent
+	registerWatcher    chan taskWatcher
 	unregisterWatcher  chan chan interface{}
-	registeredWatchers map[chan interface{}]bool
+	registeredWatchers map[chan interface{}]string
+}
+
+// taskWatcher receives events of tasks owned by tenant
+type taskWatcher struct {
+	events chan interface{}
+	tenant string
 }
 
 // NewTaskResource initializes a TaskResource
 func NewTaskResource() *TaskResource {
 
 	tr := &TaskResource{
-		eventNotifier:      make(chan interface{}),
-		registerWatcher:    make(chan chan interface{}),
+		registerWatcher:    make(chan taskWatcher),
 		unregisterWatcher:  make(chan chan interface{}),
-		registeredWatchers: make(map[chan interface{}]bool),
+		registeredWatchers: make(map[chan interface{}]string),
+	}
+
+	// changes are recorded by the store along with the task
+	// modification and published to watchers in order
+	if source, ok := db.Manager.(db.TaskEventSource); ok {
+		tr.events = source.TaskEvents()
 	}
 
 	go tr.watcherLoop()
@@ -34,76 +46,73 @@ func NewTaskResource() *TaskResource {
 	return tr
 }
 
+// taskAllowlists are derived from the types.Task tags
+var taskAllowlists = clauses.MustAllowlistsFromType(types.Task{})
+
 // allowed filters, types, and mapping to DB fields
 var (
-	allowedWhere = []clauses.AllowedWhere{
-		{
-			URLField: "id",
-			DBField:  "id",
-			Type:     "integer",
-		},
-		{
-			URLField: "name",
-			DBField:  "name",
-			Type:     "string",
-		},
-		{
-			URLField: "category",
-			DBField:  "category",
-			Type:     "string",
-		},
-		{
-			URLField: "status",
-			DBField:  "status",
-			Type:     "string",
-		},
-	}
+	allowedWhere = taskAllowlists.Where
 	// allowed order by fields
-	allowedOrder = []string{"id", "name"}
+	allowedOrder = taskAllowlists.Order
+	// allowed projection fields
+	allowedFields = taskAllowlists.Fields
 )
 
+// queryParameter returns the OpenAPI query parameter documented by p
+func queryParameter(ws *restful.WebService, p clauses.QueryParameter) *restful.Parameter {
+	return ws.QueryParameter(p.Name, p.Description).DataType(p.DataType)
+}
+
+// tasksPath is the tasks collection path. Routes are prefixed with it
+// instead of being rooted at it so that custom methods such as
+// tasks:stats can be routed
+const tasksPath = "/tasks"
+
 // Populate register the REST layer
 func (t *TaskResource) Populate(ws *restful.WebService) {
-	ws.Path(ws.RootPath() + "/tasks")
 	tags := []string{"tasks"}
 
-	rbGET := ws.GET("/").
+	rbGET := ws.GET(tasksPath).
 		To(t.listAllTasks).
 		Metadata(restfulspec.KeyOpenAPITags, tags).
 		Writes([]types.Task{}).
 		Returns(http.StatusOK, "OK", []types.Task{}).
-		Doc("get all Tasks")
-
-	for _, w := range allowedWhere {
-		rbGET.Param(
-			ws.QueryParameter(
-				w.URLField,
-				"filter field",
-			).DataType(w.Type))
+		Returns(http.StatusBadRequest, "Bad Request", nil).
+		Doc("get all Tasks. Page listings return X-Total-Count and Link headers, a X-Next-Cursor header is returned when more pages might follow")
+
+	for _, p := range taskAllowlists.FilterParameters() {
+		rbGET.Param(queryParameter(ws, p))
 	}
 
 	if len(allowedOrder) != 0 {
-		rbGET.Param(
-			ws.QueryParameter(
-				clauses.OrderByQuery,
-				fmt.Sprintf("values %v followed by a colon and asc/desc",
-					allowedOrder),
-			).DataType("string"))
+		rbGET.Param(queryParameter(ws, taskAllowlists.OrderParameter()))
 	}
 
-	// TODO page and page_size are constants at the database package
-	// move those somewhere else so we are able to use them here
 	rbGET.Param(
 		ws.QueryParameter(
-			"page",
+			clauses.SearchQuery,
+			"search terms at name and description, results are sorted by relevance unless an order is requested",
+		).DataType("string"))
+
+	rbGET.Param(queryParameter(ws, taskAllowlists.FieldsParameter()))
+
+	rbGET.Param(
+		ws.QueryParameter(
+			clauses.PageQuery,
 			"page number for listings starting from 1",
 		).DataType("integer"))
 	rbGET.Param(
 		ws.QueryParameter(
-			"page_size",
+			clauses.PageSizeQuery,
 			"page_size number of pages by page. Use 0 to list all items",
 		).DataType("integer"))
 
+	rbGET.Param(
+		ws.QueryParameter(
+			clauses.CursorQuery,
+			"cursor returned at the X-Next-Cursor header to list the next page, can't be used along with page",
+		).DataType("string"))
+
 	rbGET.Param(
 		ws.QueryParameter(
 			"watch",
@@ -112,46 +121,133 @@ func (t *TaskResource) Populate(ws *restful.WebService) {
 
 	ws.Route(rbGET)
 
+	rbStats := ws.GET(tasksPath+":stats").
+		To(t.taskStats).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(types.TaskStats{}).
+		Returns(http.StatusOK, "OK", types.TaskStats{}).
+		Returns(http.StatusBadRequest, "Bad Request", nil).
+		Param(ws.QueryParameter(groupByQuery,
+			fmt.Sprintf("comma separated fields to count tasks by, out of %v. Due groups tasks by due date as %v",
+				db.StatsGroups, []string{types.DueOverdue, types.DueToday, types.DueThisWeek, types.DueLater, types.DueNone}),
+		).DataType("string")).
+		Doc("count Tasks matching the same filters as listings, in total and by group")
+	for _, p := range taskAllowlists.FilterParameters() {
+		rbStats.Param(queryParameter(ws, p))
+	}
+	rbStats.Param(ws.QueryParameter(clauses.SearchQuery, "search terms at name and description").DataType("string"))
+	ws.Route(rbStats)
+
 	ws.Route(
-		ws.GET("/{task-id}").
+		ws.GET(tasksPath+"/{task-id}").
 			To(t.getOneTask).
 			Metadata(restfulspec.KeyOpenAPITags, tags).
 			Writes(types.Task{}).
 			Returns(http.StatusOK, "OK", types.Task{}).
 			Returns(http.StatusNotFound, "Not Found", nil).
 			Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
+			Param(queryParameter(ws, taskAllowlists.FieldsParameter())).
 			Doc("get one Task").
 			Filter(t.retrieveTaskFilter))
 
 	ws.Route(
-		ws.POST("/").
+		ws.GET(tasksPath+"/{task-id}/history").
+			To(t.getTaskHistory).
+			Metadata(restfulspec.KeyOpenAPITags, tags).
+			Writes([]types.TaskRevision{}).
+			Returns(http.StatusOK, "OK", []types.TaskRevision{}).
+			Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
+			Param(ws.QueryParameter("page", "page number for listings starting from 1").DataType("integer")).
+			Param(ws.QueryParameter("page_size", "page_size number of pages by page. Use 0 to list all items").DataType("integer")).
+			Doc("get Task revisions history, including permanently deleted Tasks"))
+
+	ws.Route(
+		ws.POST(tasksPath).
 			To(t.createTask).
 			Metadata(restfulspec.KeyOpenAPITags, tags).
 			Reads(types.Task{}).
 			Writes(types.Task{}).
 			Returns(http.StatusCreated, "Created", types.Task{}).
-			Doc("create Task"))
+			Returns(http.StatusBadRequest, "Bad Request", nil).
+			Doc(fmt.Sprintf("create Task, with one of the statuses %v", types.TaskInitialStatuses)))
 
 	ws.Route(
-		ws.PUT("/{task-id}").
+		ws.POST(tasksPath+":import").
+			To(t.importTasks).
+			Consumes(mimeNDJSON, mimeCSV).
+			Metadata(restfulspec.KeyOpenAPITags, tags).
+			Writes(types.TaskImportReport{}).
+			Returns(http.StatusOK, "OK", types.TaskImportReport{}).
+			Returns(http.StatusBadRequest, "Bad Request", nil).
+			Returns(http.StatusRequestEntityTooLarge, "Request Entity Too Large", nil).
+			Returns(http.StatusUnsupportedMediaType, "Unsupported Media Type", nil).
+			Doc(fmt.Sprintf("import Tasks from NDJSON, one task per line, or CSV with a header naming the columns. "+
+				"Valid lines are created at once and a report of accepted and rejected lines is returned. "+
+				"Up to %d tasks and %d bytes can be imported at each request", importMaxLines, importMaxBytes)))
+
+	ws.Route(
+		ws.PUT(tasksPath+"/{task-id}").
 			To(t.updateTask).
 			Metadata(restfulspec.KeyOpenAPITags, tags).
 			Reads(types.Task{}).
 			Writes(types.Task{}).
 			Returns(http.StatusOK, "OK", types.Task{}).
 			Returns(http.StatusNotFound, "Not Found", nil).
+			Returns(http.StatusConflict, "Conflict", nil).
+			Returns(http.StatusPreconditionFailed, "Precondition Failed", nil).
 			Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
-			Doc("update Task").
+			Param(ws.HeaderParameter("If-Match", "only update if the task ETag matches").DataType("string")).
+			Doc(fmt.Sprintf("update Task. Status changes must follow the allowed transitions %v, "+
+				"otherwise a conflict listing the allowed statuses is returned", types.TaskTransitions)).
 			Filter(t.retrieveTaskFilter))
 
+	for _, action := range types.TaskActionNames() {
+		status := types.TaskActions[action]
+		ws.Route(
+			ws.POST(tasksPath+"/{task-id}/"+action).
+				To(t.transitionTask(status)).
+				// no request body is read
+				Consumes("*/*").
+				Metadata(restfulspec.KeyOpenAPITags, tags).
+				Writes(types.Task{}).
+				Returns(http.StatusOK, "OK", types.Task{}).
+				Returns(http.StatusNotFound, "Not Found", nil).
+				Returns(http.StatusConflict, "Conflict", nil).
+				Returns(http.StatusPreconditionFailed, "Precondition Failed", nil).
+				Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
+				Param(ws.HeaderParameter("If-Match", "only change the task if its ETag matches").DataType("string")).
+				Doc(fmt.Sprintf("%s Task, changing its status to %s. "+
+					"A conflict listing the allowed statuses is returned if it can't change to %s",
+					action, status, status)).
+				Filter(t.retrieveTaskFilter))
+	}
+
 	ws.Route(
-		ws.DELETE("/{task-id}").
+		ws.DELETE(tasksPath+"/{task-id}").
 			To(t.deleteTask).
 			Metadata(restfulspec.KeyOpenAPITags, tags).
 			Returns(http.StatusNoContent, "No Content", nil).
 			Returns(http.StatusNotFound, "Not Found", nil).
+			Returns(http.StatusPreconditionFailed, "Precondition Failed", nil).
 			Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
+			Param(ws.HeaderParameter("If-Match", "only delete if the task ETag matches").DataType("string")).
 			Param(ws.QueryParameter("permanent", "if true performs a permanent delete instead of deactivating").DataType("boolean")).
 			Doc("deactivate Task").
 			Filter(t.retrieveTaskFilter))
+
+	ws.Route(
+		ws.POST(tasksPath+"/{task-id}/restore").
+			To(t.restoreTask).
+			// no request body is read
+			Consumes("*/*").
+			Metadata(restfulspec.KeyOpenAPITags, tags).
+			Writes(types.Task{}).
+			Returns(http.StatusOK, "OK", types.Task{}).
+			Returns(http.StatusNotFound, "Not Found", nil).
+			Returns(http.StatusConflict, "Conflict", nil).
+			Returns(http.StatusPreconditionFailed, "Precondition Failed", nil).
+			Param(ws.PathParameter("task-id", "Task identifier").DataType("integer")).
+			Param(ws.HeaderParameter("If-Match", "only restore if the task ETag matches").DataType("string")).
+			Doc("restore a deactivated Task to the status it had before being deleted").
+			Filter(t.retrieveTaskFilter))
 }
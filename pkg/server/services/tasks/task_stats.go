@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"net/http"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/server/parameters"
+	"github.com/odacremolbap/rest-demo/pkg/server/response"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+// groupByQuery at query string
+const groupByQuery = "group_by"
+
+func (t *TaskResource) taskStats(req *restful.Request, res *restful.Response) {
+	log.V(10).Info("taskStats handler", "query_params", req.Request.URL.Query())
+
+	query := parameters.URLValuesToMap(req.Request.URL.Query())
+
+	groupBy, err := statsGroupBy(query[groupByQuery])
+	if err != nil {
+		response.ErrorResponse(res, http.StatusBadRequest, err)
+		return
+	}
+
+	// same filters as task listings
+	q, err := clauses.WhereQueryFromRequest(query, allowedWhere)
+	if err != nil {
+		response.ErrorResponse(res, http.StatusBadRequest, err)
+		return
+	}
+
+	counts, err := db.Manager.TaskStats(req.Request.Context(), q, groupBy)
+	if err != nil {
+		response.ServerErrorResponse(res, err)
+		return
+	}
+
+	stats := types.TaskStats{Groups: counts}
+	for _, c := range counts {
+		stats.Total += c.Count
+	}
+	response.WriteJSON(res, http.StatusOK, stats)
+}
+
+// statsGroupBy parses the comma separated fields to group tasks by,
+// which must be one of db.StatsGroups
+func statsGroupBy(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	groupBy := []string{}
+	for _, g := range strings.Split(value, ",") {
+		g = strings.TrimSpace(g)
+		allowed := false
+		for _, s := range db.StatsGroups {
+			allowed = allowed || g == s
+		}
+		if !allowed {
+			return nil, errors.Errorf("tasks can only be grouped by %v", db.StatsGroups)
+		}
+		for _, existing := range groupBy {
+			if existing == g {
+				return nil, errors.Errorf("tasks are already grouped by %s", g)
+			}
+		}
+		groupBy = append(groupBy, g)
+	}
+	return groupBy, nil
+}
@@ -0,0 +1,108 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/odacremolbap/rest-demo/pkg/db"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
+)
+
+func TestTaskStats(t *testing.T) {
+	var testData = []struct {
+		testName         string
+		requestURL       string
+		expectedHTTPCode int
+		expectedStats    types.TaskStats
+	}{
+		{
+			testName:         "total test",
+			requestURL:       "http://test/v1/tasks:stats",
+			expectedHTTPCode: http.StatusOK,
+			expectedStats: types.TaskStats{
+				Total:  3,
+				Groups: []types.TaskCount{{Count: 3}},
+			},
+		},
+		{
+			testName:         "group by test",
+			requestURL:       "http://test/v1/tasks:stats?group_by=status,category&category[ne]=archive",
+			expectedHTTPCode: http.StatusOK,
+			expectedStats: types.TaskStats{
+				Total: 2,
+				Groups: []types.TaskCount{
+					{Group: map[string]string{"status": "pending", "category": "home"}, Count: 1},
+					{Group: map[string]string{"status": "started", "category": "home"}, Count: 1},
+				},
+			},
+		},
+		{
+			testName:         "due test",
+			requestURL:       "http://test/v1/tasks:stats?group_by=due",
+			expectedHTTPCode: http.StatusOK,
+			expectedStats: types.TaskStats{
+				Total:  3,
+				Groups: []types.TaskCount{{Group: map[string]string{"due": "none"}, Count: 3}},
+			},
+		},
+		{
+			testName:         "unknown group test",
+			requestURL:       "http://test/v1/tasks:stats?group_by=name",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+		{
+			testName:         "repeated group test",
+			requestURL:       "http://test/v1/tasks:stats?group_by=status,status",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+		{
+			testName:         "bad filter test",
+			requestURL:       "http://test/v1/tasks:stats?id=noninteger",
+			expectedHTTPCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, td := range testData {
+		db.Manager = db.NewMemoryPersistenceManager()
+		for _, task := range []types.Task{
+			{Name: "a", Category: "home", Status: types.StatusPending},
+			{Name: "b", Category: "home", Status: types.StatusStarted},
+			{Name: "c", Category: "archive", Status: types.StatusPending},
+		} {
+			task := task
+			_, err := db.Manager.CreateTask(tenant.NewContext(context.Background(), tenant.Default), &task)
+			require.Nil(t, err)
+		}
+
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", td.requestURL, nil)
+		require.Nil(t, err)
+		restful.DefaultContainer.ServeHTTP(res, req)
+
+		if !assert.Equal(t,
+			td.expectedHTTPCode,
+			res.Code,
+			"%q - HTTP status", td.testName) {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Log(string(b))
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+
+		stats := types.TaskStats{}
+		if assert.Nil(t, json.NewDecoder(res.Body).Decode(&stats), "%q - decoding stats", td.testName) {
+			assert.Equal(t, td.expectedStats, stats, "%q - stats", td.testName)
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/odacremolbap/rest-demo/pkg/db/clauses"
 	"github.com/odacremolbap/rest-demo/pkg/log"
 	"github.com/odacremolbap/rest-demo/pkg/server/response"
+	"github.com/odacremolbap/rest-demo/pkg/tenant"
+	"github.com/odacremolbap/rest-demo/pkg/types"
 	"github.com/pkg/errors"
 )
 
@@ -17,26 +19,35 @@ func (t *TaskResource) watcherLoop() {
 		select {
 		case watcher := <-t.registerWatcher:
 			{
-				log.V(10).Info("watcherLoop - registering watcher")
-				t.registeredWatchers[watcher] = true
+				log.V(10).Info("watcherLoop - registering watcher", "tenant", watcher.tenant)
+				t.registeredWatchers[watcher.events] = watcher.tenant
 			}
 		case watcher := <-t.unregisterWatcher:
 			{
 				log.V(10).Info("watcherLoop - unregistering watcher")
 				delete(t.registeredWatchers, watcher)
 			}
-		case event := <-t.eventNotifier:
+		case event := <-t.events:
 			{
-				log.V(10).Info("watcherLoop - received event")
-				for watcher := range t.registeredWatchers {
-					log.V(10).Info("loop watchher to send event")
-					watcher <- event
-				}
+				log.V(10).Info("watcherLoop - received event", "id", event.ID, "operation", event.Operation)
+				t.sendEvent(event)
 			}
 		}
 	}
 }
 
+// sendEvent forwards an event task to the registered watchers
+// of the task tenant
+func (t *TaskResource) sendEvent(event types.TaskEvent) {
+	for watcher, tenantID := range t.registeredWatchers {
+		if tenantID != event.Tenant {
+			continue
+		}
+		log.V(10).Info("loop watchher to send event")
+		watcher <- event.Task
+	}
+}
+
 func (t *TaskResource) watchTasks(req *restful.Request, res *restful.Response, query *clauses.Query) {
 	log.V(10).Info("watchTasks handler", "query", query)
 
@@ -56,8 +67,9 @@ func (t *TaskResource) watchTasks(req *restful.Request, res *restful.Response, q
 	res.AddHeader("Cache-Control", "no-cache")
 	res.AddHeader("Connection", "keep-alive")
 
+	tenantID, _ := tenant.FromContext(req.Request.Context())
 	watcher := make(chan interface{})
-	t.registerWatcher <- watcher
+	t.registerWatcher <- taskWatcher{events: watcher, tenant: tenantID}
 
 	defer func() {
 		t.unregisterWatcher <- watcher
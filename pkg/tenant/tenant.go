@@ -0,0 +1,62 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/pkg/errors"
+
+	"github.com/odacremolbap/rest-demo/pkg/server/response"
+)
+
+// Default tenant requests are served for when no authenticator
+// is configured and no other is provided
+const Default = "default"
+
+// Header the tenant is read from in development mode
+const Header = "X-Tenant"
+
+// Authenticator returns the tenant an HTTP request is authenticated for,
+// or an error if the request can't be authenticated
+type Authenticator func(req *http.Request) (string, error)
+
+// contextKey avoids collisions with other packages context values
+type contextKey struct{}
+
+// NewContext returns a context that carries a tenant
+func NewContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, contextKey{}, tenant)
+}
+
+// FromContext returns the tenant carried by a context
+func FromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(contextKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// Filter returns a restful filter setting the tenant each request is served for:
+// - the tenant of the authenticated request, if set at the request context
+// by authentication filters registered before this one
+// - the tenant returned by the authenticator if not nil, requests it
+// fails to authenticate are rejected as unauthorized
+// - the tenant header, only if devMode is enabled
+// - the default tenant otherwise
+func Filter(auth Authenticator, devMode bool) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if _, ok := FromContext(req.Request.Context()); !ok {
+			tenant := Default
+			if auth != nil {
+				var err error
+				if tenant, err = auth(req.Request); err != nil {
+					response.ErrorResponse(resp, http.StatusUnauthorized, errors.Wrap(err, "request is not authenticated"))
+					return
+				}
+			} else if h := req.HeaderParameter(Header); devMode && h != "" {
+				tenant = h
+			}
+			req.Request = req.Request.WithContext(NewContext(req.Request.Context(), tenant))
+		}
+		chain.ProcessFilter(req, resp)
+	}
+}
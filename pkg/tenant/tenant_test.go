@@ -0,0 +1,165 @@
+package tenant
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/odacremolbap/rest-demo/pkg/log"
+	"github.com/odacremolbap/rest-demo/pkg/log/dummy"
+)
+
+func TestMain(m *testing.M) {
+	// global logger must be initialized
+	log.SetDefaultLogger(&dummy.Logger{})
+	os.Exit(m.Run())
+}
+
+func TestFilter(t *testing.T) {
+	auth := TokenAuthenticator(map[string]string{"secret-a": "team-a"})
+
+	var testData = []struct {
+		testName         string
+		auth             Authenticator
+		devMode          bool
+		contextTenant    string
+		header           string
+		token            string
+		expectedHTTPCode int
+		expectedTenant   string
+	}{
+		{
+			testName:         "authenticated context test",
+			auth:             auth,
+			contextTenant:    "team-c",
+			header:           "team-b",
+			expectedHTTPCode: http.StatusOK,
+			expectedTenant:   "team-c",
+		},
+		{
+			testName:         "token test",
+			auth:             auth,
+			token:            "secret-a",
+			expectedHTTPCode: http.StatusOK,
+			expectedTenant:   "team-a",
+		},
+		{
+			testName:         "unknown token test",
+			auth:             auth,
+			token:            "secret-b",
+			expectedHTTPCode: http.StatusUnauthorized,
+		},
+		{
+			testName:         "missing token test",
+			auth:             auth,
+			header:           "team-b",
+			expectedHTTPCode: http.StatusUnauthorized,
+		},
+		{
+			testName:         "no authenticator test",
+			header:           "team-b",
+			expectedHTTPCode: http.StatusOK,
+			expectedTenant:   Default,
+		},
+		{
+			testName:         "dev mode header test",
+			devMode:          true,
+			header:           "team-b",
+			expectedHTTPCode: http.StatusOK,
+			expectedTenant:   "team-b",
+		},
+		{
+			testName:         "dev mode default test",
+			devMode:          true,
+			expectedHTTPCode: http.StatusOK,
+			expectedTenant:   Default,
+		},
+	}
+
+	for _, td := range testData {
+		var served string
+		ws := new(restful.WebService)
+		ws.Route(ws.GET("/tenant").To(func(req *restful.Request, res *restful.Response) {
+			served, _ = FromContext(req.Request.Context())
+		}))
+		container := restful.NewContainer()
+		container.Filter(Filter(td.auth, td.devMode))
+		container.Add(ws)
+
+		req := httptest.NewRequest("GET", "http://test/tenant", nil)
+		if td.contextTenant != "" {
+			req = req.WithContext(NewContext(req.Context(), td.contextTenant))
+		}
+		if td.header != "" {
+			req.Header.Set(Header, td.header)
+		}
+		if td.token != "" {
+			req.Header.Set("Authorization", "Bearer "+td.token)
+		}
+		res := httptest.NewRecorder()
+		container.ServeHTTP(res, req)
+
+		if res.Code != td.expectedHTTPCode {
+			t.Errorf("%q: got HTTP status %d, wanted %d", td.testName, res.Code, td.expectedHTTPCode)
+		}
+		if served != td.expectedTenant {
+			t.Errorf("%q: got tenant %q, wanted %q", td.testName, served, td.expectedTenant)
+		}
+	}
+}
+
+func TestReadTokensFile(t *testing.T) {
+	var testData = []struct {
+		testName       string
+		content        string
+		expectedTokens map[string]string
+		expectedError  bool
+	}{
+		{
+			testName:       "tokens test",
+			content:        "# tenant token\nteam-a secret-a\n\nteam-b  secret-b\nteam-a secret-c\n",
+			expectedTokens: map[string]string{"secret-a": "team-a", "secret-b": "team-b", "secret-c": "team-a"},
+		},
+		{
+			testName:      "missing token test",
+			content:       "team-a\n",
+			expectedError: true,
+		},
+		{
+			testName:      "repeated token test",
+			content:       "team-a secret\nteam-b secret\n",
+			expectedError: true,
+		},
+		{
+			testName:      "empty test",
+			content:       "# no tokens\n",
+			expectedError: true,
+		},
+	}
+
+	for _, td := range testData {
+		f, err := ioutil.TempFile("", "tokens")
+		if err != nil {
+			t.Fatalf("creating tokens file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err = f.WriteString(td.content); err != nil {
+			t.Fatalf("writing tokens file: %v", err)
+		}
+		f.Close()
+
+		tokens, err := ReadTokensFile(f.Name())
+		if (err != nil) != td.expectedError {
+			t.Errorf("%q: got error %v, wanted error %t", td.testName, err, td.expectedError)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, td.expectedTokens) {
+			t.Errorf("%q: got tokens %v, wanted %v", td.testName, tokens, td.expectedTokens)
+		}
+	}
+}
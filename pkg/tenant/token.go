@@ -0,0 +1,74 @@
+package tenant
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// bearerPrefix precedes the token at the Authorization header
+const bearerPrefix = "Bearer "
+
+// TokenAuthenticator returns an authenticator for requests carrying
+// a bearer token at the Authorization header, tokens maps each
+// known token to the tenant it is issued for
+func TokenAuthenticator(tokens map[string]string) Authenticator {
+	return func(req *http.Request) (string, error) {
+		h := req.Header.Get("Authorization")
+		if !strings.HasPrefix(h, bearerPrefix) {
+			return "", errors.New("missing bearer token")
+		}
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(h, bearerPrefix)))
+
+		tenant := ""
+		// all tokens are compared so that timing reveals nothing
+		for t, tn := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+				tenant = tn
+			}
+		}
+		if tenant == "" {
+			return "", errors.New("unknown bearer token")
+		}
+		return tenant, nil
+	}
+}
+
+// ReadTokensFile reads the tokens file at path, each line holding a
+// tenant and a token issued for it separated by spaces.
+// Blank lines and lines starting with # are ignored
+func ReadTokensFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening tokens file")
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("tokens file line %d must hold a tenant and a token", n)
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, errors.Errorf("tokens file line %d repeats a token", n)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading tokens file")
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("tokens file holds no tokens")
+	}
+	return tokens, nil
+}
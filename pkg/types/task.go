@@ -33,14 +33,17 @@ var TaskStatus = [9]string{
 }
 
 // Task defines an element at the TODO list
+// The db, filter and sort tags declare how listings can be
+// filtered, sorted and projected, see clauses.AllowlistsFromType
 type Task struct {
-	ID          int        `json:"id"`
-	Name        string     `json:"name"`
-	Description string     `json:"description,omitempty"`
-	Category    string     `json:"category,omitempty"`
-	Status      string     `json:"status"`
-	DueDate     *time.Time `json:"due_date,omitempty"`
-	Created     *time.Time `json:"created"`
+	ID          int        `json:"id" db:"id" filter:"id,ops=eq|ne|gt|gte|lt|lte|in" sort:"id"`
+	Name        string     `json:"name" db:"name" filter:"name,ops=eq|ne|in|like" sort:"name"`
+	Description string     `json:"description,omitempty" db:"description"`
+	Category    string     `json:"category,omitempty" db:"category" filter:"category,ops=eq|ne|in|like" sort:"category"`
+	Status      string     `json:"status" db:"status" filter:"status,ops=eq|ne|in" sort:"status"`
+	DueDate     *time.Time `json:"due_date,omitempty" db:"duedate" filter:"due_before,cmp=<;due_after,cmp=>;has_due_date,type=presence" sort:"due_date"`
+	Created     *time.Time `json:"created" db:"created" filter:"created_before,cmp=<;created_after,cmp=>" sort:"created"`
+	Version     int        `json:"version" db:"version"`
 }
 
 // Validate a Task data
@@ -68,9 +71,9 @@ func (t *Task) Validate() error {
 	}
 
 	found := false
-	status := strings.ToLower(t.Status)
+	t.Status = strings.ToLower(t.Status)
 	for _, s := range TaskStatus {
-		if s == status {
+		if s == t.Status {
 			found = true
 			break
 		}
@@ -0,0 +1,12 @@
+package types
+
+// TaskEvent informs about an operation executed on a Task
+// owned by Tenant. ID is the event position, events are
+// delivered in ID order.
+// For deleted tasks it contains the last state of the task
+type TaskEvent struct {
+	ID        int    `json:"id"`
+	Operation string `json:"operation"`
+	Tenant    string `json:"tenant"`
+	Task      *Task  `json:"task"`
+}
@@ -0,0 +1,17 @@
+package types
+
+// TaskImportLine is the result of importing one line of a tasks file.
+// ID is set for accepted lines and Error for rejected ones
+type TaskImportLine struct {
+	Line     int    `json:"line"`
+	Accepted bool   `json:"accepted"`
+	ID       int    `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// TaskImportReport summarizes a tasks import, listing every imported line
+type TaskImportReport struct {
+	Accepted int              `json:"accepted"`
+	Rejected int              `json:"rejected"`
+	Lines    []TaskImportLine `json:"lines"`
+}
@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// Operations recorded for task revisions
+const (
+	OperationCreate string = "create"
+	OperationUpdate string = "update"
+	OperationDelete string = "delete"
+)
+
+// TaskRevision records a change on a Task.
+// Old is empty for created tasks and New is empty for deleted ones
+type TaskRevision struct {
+	ID        int        `json:"id"`
+	TaskID    int        `json:"task_id"`
+	Operation string     `json:"operation"`
+	Old       *Task      `json:"old,omitempty"`
+	New       *Task      `json:"new,omitempty"`
+	Created   *time.Time `json:"created"`
+}
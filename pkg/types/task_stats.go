@@ -0,0 +1,23 @@
+package types
+
+// Due date buckets tasks are grouped by
+const (
+	DueNone     = "none"
+	DueOverdue  = "overdue"
+	DueToday    = "today"
+	DueThisWeek = "this_week"
+	DueLater    = "later"
+)
+
+// TaskCount is the number of tasks at a group. Group holds the value
+// of each field tasks were grouped by, and is empty if not grouped
+type TaskCount struct {
+	Group map[string]string `json:"group,omitempty"`
+	Count int               `json:"count"`
+}
+
+// TaskStats counts tasks matching a listing filters, in total and by group
+type TaskStats struct {
+	Total  int         `json:"total"`
+	Groups []TaskCount `json:"groups"`
+}
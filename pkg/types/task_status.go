@@ -0,0 +1,85 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TaskTransitions lists the statuses each task status can change to.
+// Tasks move forward from pending to started and finished, and can be
+// canceled at any point. Only canceled tasks can be reopened as pending.
+// Tasks are deleted and restored through their own operations,
+// so deleted can't be reached nor left by changing the status
+var TaskTransitions = map[string][]string{
+	StatusPending:  {StatusStarted, StatusCanceled},
+	StatusStarted:  {StatusFinished, StatusCanceled},
+	StatusFinished: {StatusCanceled},
+	StatusCanceled: {StatusPending},
+	StatusDeleted:  {},
+}
+
+// TaskInitialStatuses lists the statuses tasks can be created with,
+// those a new pending task can reach by changing its status
+var TaskInitialStatuses = []string{StatusPending, StatusStarted, StatusFinished, StatusCanceled}
+
+// TaskActions maps the actions that can be performed on a task
+// to the status they change it to
+var TaskActions = map[string]string{
+	"start":  StatusStarted,
+	"finish": StatusFinished,
+	"cancel": StatusCanceled,
+	"reopen": StatusPending,
+}
+
+// TaskActionNames returns the task action names, sorted
+func TaskActionNames() []string {
+	names := make([]string, 0, len(TaskActions))
+	for name := range TaskActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TransitionError is returned when a task status can't change
+// to another, Allowed lists the statuses it can change to.
+// From is empty for tasks being created
+type TransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *TransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("Task can't be created with status %s, allowed statuses are %v",
+			e.To, e.Allowed)
+	}
+	return fmt.Sprintf("Task status can't change from %s to %s, allowed statuses are %v",
+		e.From, e.To, e.Allowed)
+}
+
+// CheckInitialStatus checks that a task can be created with a status
+func CheckInitialStatus(status string) error {
+	for _, s := range TaskInitialStatuses {
+		if s == status {
+			return nil
+		}
+	}
+	return &TransitionError{To: status, Allowed: append([]string{}, TaskInitialStatuses...)}
+}
+
+// CheckTransition checks that a task status can change from one status
+// to another, keeping the same status is always allowed
+func CheckTransition(from, to string) error {
+	if from == to {
+		return nil
+	}
+	allowed := TaskTransitions[from]
+	for _, s := range allowed {
+		if s == to {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to, Allowed: append([]string{}, allowed...)}
+}